@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// requireAdmin only lets through requests bearing -admin-token.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *adminToken == "" {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": "admin_disabled"})
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func closeRoomHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["id"]
+	if !hub.closeRoom(roomID) {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "room_not_found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"room": roomID, "status": "closed"})
+}
+
+// closeRoom shuts a room down on an operator's request. Deleting it stops
+// any round timers, and its members are disconnected.
+func (h *Hub) closeRoom(roomID string) bool {
+	h.lock.Lock()
+	room, exists := h.rooms[roomID]
+	if !exists {
+		h.lock.Unlock()
+		return false
+	}
+	room.logger().Warn("Closing room by admin request", "event", "room_closed")
+	members := room.members()
+	h.deleteRoom(roomID)
+	h.lock.Unlock()
+
+	evict(members, "admin", "room closed by an administrator")
+	return true
+}
+
+func abortRoundHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := mux.Vars(r)["id"]
+	hub.lock.RLock()
+	room, exists := hub.rooms[roomID]
+	hub.lock.RUnlock()
+	if !exists {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "room_not_found"})
+		return
+	}
+	status := "idle"
+	if room.abortRound() {
+		status = "aborted"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"room": roomID, "status": status})
+}
+
+// abortRound throws away the game in progress, for when a round is stuck
+// and won't resolve on its own. Everyone stays in the room and the room
+// goes back to Waiting. It returns false if no game was being played.
+func (r *Room) abortRound() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state == Waiting {
+		return false
+	}
+	r.logger().Warn("Aborting round by admin request", "event", "round_aborted", "round", r.round)
+	r.resetForNextGameLocked()
+	r.shot = make(map[string]bool)
+	r.reshoot = false
+	r.broadcastLocked(marshal(map[string]interface{}{"round": "aborted"}))
+	return true
+}
+
+type debugClient struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	RoomID     string     `json:"roomID"`
+	ShootState ShootState `json:"shootState"`
+	Ready      bool       `json:"ready"`
+	Spectator  bool       `json:"spectator,omitempty"`
+	Bot        bool       `json:"bot,omitempty"`
+}
+
+type debugRoom struct {
+	ID             string        `json:"id"`
+	State          string        `json:"state"`
+	Mode           GameMode      `json:"mode"`
+	RoundsToWin    int           `json:"roundsToWin,omitempty"`
+	Owner          string        `json:"owner"`
+	Round          int           `json:"round"`
+	RoundOpen      bool          `json:"roundOpen"`
+	AcceptingShots bool          `json:"acceptingShots"`
+	ActivePlayers  []string      `json:"activePlayers"`
+	Clients        []debugClient `json:"clients"`
+}
+
+type debugState struct {
+	Rooms []debugRoom `json:"rooms"`
+	// Lobby lists connected clients that aren't in any room
+	Lobby    []string `json:"lobby"`
+	Sessions int      `json:"sessions"`
+}
+
+func debugStateHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, hub.debugState())
+}
+
+// debugState snapshots every room and client. Locks are taken in the usual
+// order: the hub, then each room in turn.
+func (h *Hub) debugState() debugState {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	state := debugState{Rooms: make([]debugRoom, 0, len(h.rooms)), Lobby: []string{}, Sessions: len(h.sessions)}
+	inRoom := make(map[string]bool)
+	for _, room := range h.rooms {
+		snapshot := room.debugSnapshot()
+		for _, client := range snapshot.Clients {
+			inRoom[client.ID] = true
+		}
+		state.Rooms = append(state.Rooms, snapshot)
+	}
+	for id := range h.clients {
+		if !inRoom[id] {
+			state.Lobby = append(state.Lobby, id)
+		}
+	}
+	sort.Slice(state.Rooms, func(i, j int) bool { return state.Rooms[i].ID < state.Rooms[j].ID })
+	sort.Strings(state.Lobby)
+	return state
+}
+
+func (r *Room) debugSnapshot() debugRoom {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	snapshot := debugRoom{
+		ID:             r.id,
+		State:          r.state.String(),
+		Mode:           r.gameMode,
+		RoundsToWin:    r.roundsToWin,
+		Owner:          r.ownerID,
+		Round:          r.round,
+		RoundOpen:      r.roundOpen,
+		AcceptingShots: r.acceptingShots,
+		ActivePlayers:  make([]string, 0, len(r.activePlayers)),
+		Clients:        make([]debugClient, 0, len(r.clients)+len(r.spectators)),
+	}
+	for id := range r.activePlayers {
+		snapshot.ActivePlayers = append(snapshot.ActivePlayers, id)
+	}
+	for _, members := range []map[string]*Client{r.clients, r.spectators} {
+		for _, client := range members {
+			snapshot.Clients = append(snapshot.Clients, debugClient{
+				ID:         client.id,
+				Name:       client.name,
+				RoomID:     r.id,
+				ShootState: client.shootState,
+				Ready:      r.isReadyLocked(client.id),
+				Spectator:  client.spectator,
+				Bot:        client.bot != nil,
+			})
+		}
+	}
+	sort.Strings(snapshot.ActivePlayers)
+	sort.Slice(snapshot.Clients, func(i, j int) bool { return snapshot.Clients[i].ID < snapshot.Clients[j].ID })
+	return snapshot
+}
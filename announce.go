@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const maxAnnouncementLength = 500
+
+// announceLimiter keeps a stuck script or a double-clicked button from
+// spamming every player: a few announcements at once, then one every ten
+// seconds.
+var (
+	announceLock    sync.Mutex
+	announceLimiter = newTokenBucket(0.1, 3)
+)
+
+type announceRequest struct {
+	Text string `json:"text"`
+}
+
+// announceHandler pushes an operator's banner to every connected client,
+// whether in a room, in the lobby or not yet joined.
+func announceHandler(w http.ResponseWriter, r *http.Request) {
+	var req announceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request", "detail": err.Error()})
+		return
+	}
+	text := stripControl(req.Text)
+	if text == "" || utf8.RuneCountInString(text) > maxAnnouncementLength {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request", "detail": fmt.Sprintf("text must be 1 to %d characters", maxAnnouncementLength)})
+		return
+	}
+
+	announceLock.Lock()
+	allowed := announceLimiter.allow(time.Now())
+	announceLock.Unlock()
+	if !allowed {
+		writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{"error": "rate_limited"})
+		return
+	}
+
+	n := hub.announce(text)
+	slog.Warn("Announcement sent", "event", "announcement", "text", text, "clients", n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": n})
+}
+
+// announce queues the text for every connected client and returns how many
+// there were.
+func (h *Hub) announce(text string) int {
+	res := marshal(map[string]interface{}{"announcement": text})
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, client := range h.clients {
+		client.enqueue(res)
+	}
+	return len(h.clients)
+}
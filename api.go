@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type roomSummary struct {
+	ID             string `json:"id"`
+	PlayerCount    int    `json:"playerCount"`
+	SpectatorCount int    `json:"spectatorCount"`
+	State          string `json:"state"`
+	Private        bool   `json:"private"`
+}
+
+type roomDetail struct {
+	ID             string          `json:"id"`
+	State          string          `json:"state"`
+	Mode           GameMode        `json:"mode"`
+	Bracket        bool            `json:"bracket,omitempty"`
+	PlayerCount    int             `json:"playerCount"`
+	MaxPlayers     int             `json:"maxPlayers"`
+	SpectatorCount int             `json:"spectatorCount"`
+	MaxSpectators  int             `json:"maxSpectators"`
+	Clients        []string        `json:"clients"`
+	Ready          map[string]bool `json:"ready"`
+	ActivePlayers  []string        `json:"activePlayers"`
+}
+
+type clientStatus struct {
+	RoomID         string `json:"roomID"`
+	State          string `json:"state"`
+	IsActivePlayer bool   `json:"isActivePlayer"`
+	Ready          bool   `json:"ready"`
+}
+
+// shuttingDown flips once graceful shutdown begins so load balancers stop
+// routing new players here.
+var shuttingDown atomic.Bool
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "shutting_down"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Encode error", "error", err)
+	}
+}
+
+func listRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, hub.roomSummaries())
+}
+
+func getRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room := hub.lookupRoom(mux.Vars(r)["id"])
+	if room == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "room_not_found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, room.detail())
+}
+
+// getClientHandler tells a reconnecting or monitoring client where a player
+// is seated.
+func getClientHandler(w http.ResponseWriter, r *http.Request) {
+	status, ok := hub.clientStatus(mux.Vars(r)["id"])
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "client_not_found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// clientStatus finds the room seating the client. Rooms are scanned rather
+// than trusting the client's own roomID, which its goroutines may be
+// changing under us.
+func (h *Hub) clientStatus(clientID string) (clientStatus, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, room := range h.rooms {
+		if status, ok := room.clientStatus(clientID); ok {
+			return status, true
+		}
+	}
+	return clientStatus{}, false
+}
+
+func (r *Room) clientStatus(clientID string) (clientStatus, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if _, exists := r.clients[clientID]; !exists {
+		return clientStatus{}, false
+	}
+	return clientStatus{
+		RoomID:         r.id,
+		State:          r.state.String(),
+		IsActivePlayer: r.activePlayers[clientID] != nil,
+		Ready:          r.ready[clientID],
+	}, true
+}
+
+func (h *Hub) roomSummaries() []roomSummary {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.roomSummariesLocked()
+}
+
+// roomSummariesLocked must be called with h.lock held.
+func (h *Hub) roomSummariesLocked() []roomSummary {
+	summaries := make([]roomSummary, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		summaries = append(summaries, room.summary())
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+	return summaries
+}
+
+func (r *Room) summary() roomSummary {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return roomSummary{
+		ID:             r.id,
+		PlayerCount:    len(r.clients),
+		SpectatorCount: len(r.spectators),
+		State:          r.state.String(),
+		Private:        r.password != nil,
+	}
+}
+
+func (r *Room) detail() roomDetail {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	detail := roomDetail{
+		ID:             r.id,
+		State:          r.state.String(),
+		Mode:           r.gameMode,
+		Bracket:        r.bracket,
+		PlayerCount:    len(r.clients),
+		MaxPlayers:     r.maxPlayers,
+		SpectatorCount: len(r.spectators),
+		MaxSpectators:  r.maxSpectators,
+		Clients:        make([]string, 0, len(r.clients)),
+		Ready:          make(map[string]bool, len(r.clients)),
+		ActivePlayers:  make([]string, 0, len(r.activePlayers)),
+	}
+	for id := range r.clients {
+		detail.Clients = append(detail.Clients, id)
+		detail.Ready[id] = r.ready[id]
+	}
+	for id := range r.activePlayers {
+		detail.ActivePlayers = append(detail.ActivePlayers, id)
+	}
+	sort.Strings(detail.Clients)
+	sort.Strings(detail.ActivePlayers)
+	return detail
+}
+
+// createRoomRequest configures a room ahead of its first join. The server
+// picks a room code unless ID asks for a specific one. RoundTimeout is a Go
+// duration string such as "8s".
+type createRoomRequest struct {
+	ID         string `json:"id"`
+	Mode       string `json:"mode"`
+	Rounds     *int   `json:"rounds"`
+	MaxPlayers int    `json:"maxPlayers"`
+	// MaxSpectators caps spectators separately from MaxPlayers
+	MaxSpectators int    `json:"maxSpectators"`
+	RoundTimeout  string `json:"roundTimeout"`
+	// AllowShotChange overrides -allow-shot-change for this room
+	AllowShotChange *bool `json:"allowShotChange"`
+	// TieBreak is "draw" (the default) or "reshoot"
+	TieBreak string `json:"tieBreak"`
+	// Password makes the room invite-only
+	Password string `json:"password"`
+	// AutoStart begins the game once maxPlayers have joined
+	AutoStart bool `json:"autoStart"`
+}
+
+const (
+	minRoomRoundTimeout = time.Second
+	maxRoomRoundTimeout = 5 * time.Minute
+)
+
+// createRoomHandler creates a room with the requested options under a
+// generated id. Players who join it later get those options.
+func createRoomHandler(w http.ResponseWriter, r *http.Request) {
+	var req createRoomRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request", "detail": err.Error()})
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request", "detail": err.Error()})
+		return
+	}
+
+	hub.lock.Lock()
+	roomID := req.ID
+	if roomID == "" {
+		roomID = hub.generateRoomCode()
+	} else if _, exists := hub.rooms[roomID]; exists {
+		hub.lock.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": "room_exists"})
+		return
+	}
+	room, err := hub.createRoom(roomID, opts)
+	hub.lock.Unlock()
+	if err == errServerFull {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "server_full"})
+		return
+	}
+	room.logger().Info("Room created over HTTP", "event", "room_created", "mode", opts.mode)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": room.id})
+}
+
+func (req createRoomRequest) options() (roomOptions, error) {
+	opts, err := parseRoomMode(req.Mode, req.Rounds)
+	if err != nil {
+		return roomOptions{}, err
+	}
+	if req.MaxPlayers != 0 {
+		if req.MaxPlayers < *minPlayers {
+			return roomOptions{}, fmt.Errorf("maxPlayers must be at least %d", *minPlayers)
+		}
+		if *maxPlayers > 0 && req.MaxPlayers > *maxPlayers {
+			return roomOptions{}, fmt.Errorf("maxPlayers must be at most %d", *maxPlayers)
+		}
+		opts.maxPlayers = req.MaxPlayers
+	}
+	if req.MaxSpectators != 0 {
+		if req.MaxSpectators < 0 {
+			return roomOptions{}, fmt.Errorf("maxSpectators must be at least 1")
+		}
+		if *maxSpectators > 0 && req.MaxSpectators > *maxSpectators {
+			return roomOptions{}, fmt.Errorf("maxSpectators must be at most %d", *maxSpectators)
+		}
+		opts.maxSpectators = req.MaxSpectators
+	}
+	if req.RoundTimeout != "" {
+		timeout, err := time.ParseDuration(req.RoundTimeout)
+		if err != nil {
+			return roomOptions{}, fmt.Errorf("roundTimeout: %w", err)
+		}
+		if timeout < minRoomRoundTimeout || timeout > maxRoomRoundTimeout {
+			return roomOptions{}, fmt.Errorf("roundTimeout must be between %s and %s", minRoomRoundTimeout, maxRoomRoundTimeout)
+		}
+		opts.roundTimeout = timeout
+	}
+	opts.allowShotChange = req.AllowShotChange
+	if !validTieBreak(req.TieBreak) {
+		return roomOptions{}, fmt.Errorf("tieBreak must be %q or %q", tieBreakDraw, tieBreakReshoot)
+	}
+	opts.tieBreak = req.TieBreak
+	if len(req.Password) > maxPasswordLength {
+		return roomOptions{}, fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	}
+	opts.password = req.Password
+	opts.autoStart = req.AutoStart
+	return opts, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+// autoStartIfFull starts the game once an auto-start room has filled up,
+// with every player marked ready as if they had all sent fight.
+func (r *Room) autoStartIfFull() {
+	r.lock.Lock()
+	full := r.autoStart && r.state == Waiting && r.maxPlayers > 0 && len(r.clients) >= r.maxPlayers
+	if full {
+		for id := range r.clients {
+			r.ready[id] = true
+		}
+	}
+	r.lock.Unlock()
+	if !full {
+		return
+	}
+
+	started, err := r.tryStart(false)
+	if err != nil {
+		r.logger().Info("Auto-start failed", "event", "auto_start_failed", "error", err)
+		return
+	}
+	if started {
+		r.logger().Info("Room full, starting", "event", "auto_start")
+		r.startGame()
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/google/uuid"
+)
+
+// botStrategy decides what a bot throws each round, given what its
+// opponents have thrown so far this game. Randomness comes from intn, the
+// room's generator, so seeded games are reproducible. The other strategies
+// are in botstrategy.go.
+type botStrategy interface {
+	choose(mode GameMode, history []ShootState, intn func(n int) int) ShootState
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) choose(mode GameMode, history []ShootState, intn func(n int) int) ShootState {
+	choices := mode.choices()
+	return choices[intn(len(choices))]
+}
+
+// newBot creates a player run by the server. It has no connection, so
+// everything the room sends it lands in its queue for runBot to act on.
+func newBot(strategy botStrategy) *Client {
+	id := uuid.New().String()
+	bot := &Client{
+		id:         id,
+		name:       "Bot-" + id[:4],
+		shootState: None,
+		send:       make(chan []byte, *sendBuffer),
+		bot:        strategy,
+	}
+	bot.ctx, bot.cancel = context.WithCancel(context.Background())
+	return bot
+}
+
+// runBot plays for the bot until its queue is closed, then leaves the room
+// the way a disconnecting client would. Bots are always ready, so the only
+// thing they need to react to is the call to shoot.
+func (c *Client) runBot(room *Room) {
+	defer func() {
+		c.cancel()
+		c.leaveRoom()
+	}()
+	for {
+		var message []byte
+		select {
+		case <-c.ctx.Done():
+			return
+		case m, ok := <-c.send:
+			if !ok {
+				return
+			}
+			message = m
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal(message, &data); err != nil {
+			continue
+		}
+		if data["shoot"] == "go" {
+			c.handleShoot(ShootMsg{Shoot: c.bot.choose(room.gameMode, room.opponentChoices(c.id), room.intn)})
+		}
+	}
+}
+
+// handleAddBot lets the owner fill a seat with a bot before a game.
+// {"addBot":{"strategy":"markov"}} picks how it plays; otherwise it plays
+// at random.
+func (c *Client) handleAddBot(msg AddBotMsg) {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	if !room.isOwner(c) {
+		c.sendError("not_owner", "")
+		return
+	}
+	if state, _ := room.gameState(); state != Waiting {
+		c.sendError("game_in_progress", "")
+		return
+	}
+	bot := newBot(botStrategies[msg.strategy()])
+	room, err := hub.joinRoom(room.id, "", roomOptions{}, bot, seat{name: bot.name})
+	if err != nil {
+		slog.Info("Bot not added", "client_id", c.id, "room_id", c.roomID, "error", err)
+		c.sendJoinError(err)
+		bot.closeSend()
+		return
+	}
+	bot.completeJoin(room.id, room, nil)
+	go bot.runBot(room)
+}
+
+// handleRemoveBot takes a bot out of the room. {"removeBot":"<id>"} picks
+// a specific bot; anything else removes one of them.
+func (c *Client) handleRemoveBot(msg RemoveBotMsg) {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	if !room.isOwner(c) {
+		c.sendError("not_owner", "")
+		return
+	}
+	botID, _ := msg.RemoveBot.(string)
+	var bot *Client
+	for _, b := range room.bots() {
+		if botID == "" || b.id == botID {
+			bot = b
+			break
+		}
+	}
+	if bot == nil {
+		c.sendError("unknown_bot", "")
+		return
+	}
+	// runBot sees the queue close and takes the bot out of the room
+	bot.closeSend()
+}
+
+func (r *Room) bots() []*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var bots []*Client
+	for _, client := range r.clients {
+		if client.bot != nil {
+			bots = append(bots, client)
+		}
+	}
+	return bots
+}
+
+// removeBotsIfAlone sends the bots away once the last human player or
+// spectator has gone, so the room can be deleted.
+func (r *Room) removeBotsIfAlone() {
+	bots := r.bots()
+	if len(bots) == 0 || len(r.members()) > len(bots) {
+		return
+	}
+	for _, bot := range bots {
+		bot.closeSend()
+	}
+}
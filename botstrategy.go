@@ -0,0 +1,106 @@
+package main
+
+import "sort"
+
+// Bot strategies that learn from the game look at the choices the bot's
+// opponents made in earlier rounds, oldest first.
+
+type alwaysRockStrategy struct{}
+
+func (alwaysRockStrategy) choose(mode GameMode, history []ShootState, intn func(n int) int) ShootState {
+	return Rock
+}
+
+// frequencyStrategy counters the choice its opponents have made most.
+type frequencyStrategy struct{}
+
+func (frequencyStrategy) choose(mode GameMode, history []ShootState, intn func(n int) int) ShootState {
+	counts := make(map[ShootState]int)
+	for _, choice := range history {
+		counts[choice]++
+	}
+	return counter(mode, mostCommon(mode, counts), intn)
+}
+
+// markovStrategy predicts its opponents' next choice from what has followed
+// their last one before, and counters it.
+type markovStrategy struct{}
+
+func (markovStrategy) choose(mode GameMode, history []ShootState, intn func(n int) int) ShootState {
+	if len(history) == 0 {
+		return randomStrategy{}.choose(mode, history, intn)
+	}
+	last := history[len(history)-1]
+	next := make(map[ShootState]int)
+	for i := 0; i+1 < len(history); i++ {
+		if history[i] == last {
+			next[history[i+1]]++
+		}
+	}
+	return counter(mode, mostCommon(mode, next), intn)
+}
+
+var botStrategies = map[string]botStrategy{
+	"random":            randomStrategy{},
+	"always-rock":       alwaysRockStrategy{},
+	"frequency":         frequencyStrategy{},
+	"frequency-counter": frequencyStrategy{},
+	"markov":            markovStrategy{},
+}
+
+func botStrategyNames() []string {
+	names := make([]string, 0, len(botStrategies))
+	for name := range botStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mostCommon returns the choice counted most often, the earliest in the
+// mode's order on a tie, or None if nothing was counted.
+func mostCommon(mode GameMode, counts map[ShootState]int) ShootState {
+	best := None
+	for _, choice := range mode.choices() {
+		if counts[choice] > counts[best] {
+			best = choice
+		}
+	}
+	return best
+}
+
+// counter picks a choice that beats predicted, or any choice when there is
+// no prediction.
+func counter(mode GameMode, predicted ShootState, intn func(n int) int) ShootState {
+	var winning []ShootState
+	for _, choice := range mode.choices() {
+		if beats(choice, predicted) {
+			winning = append(winning, choice)
+		}
+	}
+	if len(winning) == 0 {
+		winning = mode.choices()
+	}
+	return winning[intn(len(winning))]
+}
+
+// opponentChoices flattens the room's round history into the choices made
+// by everyone but the bot, in id order within each round.
+func (r *Room) opponentChoices(botID string) []ShootState {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var history []ShootState
+	for _, round := range r.history {
+		ids := make([]string, 0, len(round.Choices))
+		for id := range round.Choices {
+			if id != botID {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			history = append(history, round.Choices[id])
+		}
+	}
+	return history
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestFrequencyBeatsAlwaysRock plays the frequency bot against always-rock.
+// After the first round it has seen enough to win every time.
+func TestFrequencyBeatsAlwaysRock(t *testing.T) {
+	const rounds = 200
+	for _, mode := range []GameMode{ClassicMode, LizardSpockMode} {
+		intn := rand.New(rand.NewSource(1)).Intn
+		var history []ShootState
+		wins, losses := 0, 0
+		for i := 0; i < rounds; i++ {
+			bot := botStrategies["frequency-counter"].choose(mode, history, intn)
+			rock := botStrategies["always-rock"].choose(mode, nil, intn)
+			if !mode.isValidChoice(bot) {
+				t.Fatalf("%s round %d: bot chose %v", mode, i+1, bot)
+			}
+			switch {
+			case beats(bot, rock):
+				wins++
+			case beats(rock, bot):
+				losses++
+			}
+			history = append(history, rock)
+		}
+		if wins < rounds-1 || losses > 1 {
+			t.Errorf("%s: frequency won %d and lost %d of %d rounds", mode, wins, losses, rounds)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import "sort"
+
+// In bracket rooms, created with mode "bracket", each round pairs the active
+// players off into 1-vs-1 matchups instead of everyone throwing at once.
+// Each pair is settled on its own and its winner goes through; with an odd
+// number of players one of them sits the round out and goes through too.
+
+// BracketMsg announces a round's matchups.
+type BracketMsg struct {
+	Bracket [][2]string `json:"bracket"`
+	Bye     string      `json:"bye,omitempty"`
+}
+
+// pairPlayersLocked draws the matchups for a new round from the room's
+// generator and announces them. Must be called with r.lock held.
+func (r *Room) pairPlayersLocked() {
+	ids := make([]string, 0, len(r.activePlayers))
+	for id := range r.activePlayers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for i := len(ids) - 1; i > 0; i-- {
+		j := r.intn(i + 1)
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+
+	r.opponents = make(map[string]string, len(ids))
+	msg := BracketMsg{Bracket: [][2]string{}}
+	for i := 0; i+1 < len(ids); i += 2 {
+		r.opponents[ids[i]] = ids[i+1]
+		r.opponents[ids[i+1]] = ids[i]
+		msg.Bracket = append(msg.Bracket, [2]string{ids[i], ids[i+1]})
+	}
+	if len(ids)%2 == 1 {
+		msg.Bye = ids[len(ids)-1]
+	}
+	r.broadcastLocked(marshal(msg))
+}
+
+// determineBracketResults settles each matchup on its own. A player who
+// beats their opponent goes through and the opponent is out; a player
+// whose opponent didn't shoot or has left goes through, as does the bye. A
+// drawn matchup sends both players through to be paired again. Like
+// determineWinnersAndLosers, both slices are sorted by client id.
+func (r *Room) determineBracketResults() (winners []*Client, losers []*Client, drawReason string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	shots := 0
+	for id, client := range r.activePlayers {
+		if client.shootState != None {
+			shots++
+		}
+		opponent := r.activePlayers[r.opponents[id]]
+		switch {
+		case opponent == nil, beats(client.shootState, opponent.shootState):
+			winners = append(winners, client)
+		case beats(opponent.shootState, client.shootState):
+			losers = append(losers, client)
+		case client.shootState != None || opponent.shootState == None:
+			// The same choice, or neither of them shot
+			winners = append(winners, client)
+		default:
+			losers = append(losers, client)
+		}
+	}
+	sortClients(winners)
+	sortClients(losers)
+	if len(losers) > 0 {
+		return winners, losers, ""
+	}
+	if shots == 0 {
+		return winners, nil, drawNoShots
+	}
+	return winners, nil, drawSame
+}
+
+// opponentLocked is who the player faced this round, if anyone. Must be
+// called with r.lock held.
+func (r *Room) opponentLocked(clientID string) []string {
+	if opponent, exists := r.opponents[clientID]; exists {
+		return []string{opponent}
+	}
+	return nil
+}
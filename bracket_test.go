@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBracketPairing(t *testing.T) {
+	for _, n := range []int{2, 3, 4, 5} {
+		room := newRoom(t.Name(), roomOptions{mode: ClassicMode, bracket: true})
+		var members []*Client
+		for i := 0; i < n; i++ {
+			member := newTestMember(string(rune('a' + i)))
+			room.addClient(member, seat{name: member.id})
+			room.setReady(member.id, true)
+			members = append(members, member)
+		}
+		if started, err := room.tryStart(false); !started || err != nil {
+			t.Fatalf("%d players: tryStart = %v, %v", n, started, err)
+		}
+		room.startRound()
+
+		var bracket BracketMsg
+		for _, msg := range queuedMessages(members[0]) {
+			if msg["bracket"] != nil {
+				json.Unmarshal(marshal(msg), &bracket)
+			}
+		}
+		var seen []string
+		for _, pair := range bracket.Bracket {
+			seen = append(seen, pair[0], pair[1])
+			if room.opponents[pair[0]] != pair[1] || room.opponents[pair[1]] != pair[0] {
+				t.Errorf("%d players: pair %v not recorded as opponents", n, pair)
+			}
+		}
+		if len(bracket.Bracket) != n/2 {
+			t.Errorf("%d players: %d pairs, want %d", n, len(bracket.Bracket), n/2)
+		}
+		if n%2 == 0 && bracket.Bye != "" {
+			t.Errorf("%d players: bye %q, want none", n, bracket.Bye)
+		}
+		if n%2 == 1 {
+			if _, paired := room.opponents[bracket.Bye]; bracket.Bye == "" || paired {
+				t.Errorf("%d players: bye %q, want an unpaired player", n, bracket.Bye)
+			}
+			seen = append(seen, bracket.Bye)
+		}
+		sort.Strings(seen)
+		if want := byMemberID(members); !reflect.DeepEqual(seen, want) {
+			t.Errorf("%d players: bracket covers %v, want %v", n, seen, want)
+		}
+	}
+}
+
+func TestBracketResults(t *testing.T) {
+	tests := []struct {
+		name       string
+		shots      map[string]ShootState
+		pairs      [][2]string
+		winners    []string
+		losers     []string
+		drawReason string
+	}{
+		{
+			name:    "two matchups",
+			shots:   map[string]ShootState{"a": Paper, "b": Rock, "c": Scissors, "d": Paper},
+			pairs:   [][2]string{{"a", "b"}, {"c", "d"}},
+			winners: []string{"a", "c"},
+			losers:  []string{"b", "d"},
+		},
+		{
+			name:    "bye goes through",
+			shots:   map[string]ShootState{"a": Rock, "b": Scissors, "c": Paper},
+			pairs:   [][2]string{{"a", "b"}},
+			winners: []string{"a", "c"},
+			losers:  []string{"b"},
+		},
+		{
+			name:    "bye who didn't shoot goes through",
+			shots:   map[string]ShootState{"a": Rock, "b": Scissors, "c": None},
+			pairs:   [][2]string{{"a", "b"}},
+			winners: []string{"a", "c"},
+			losers:  []string{"b"},
+		},
+		{
+			name:    "walkover",
+			shots:   map[string]ShootState{"a": None, "b": Rock, "c": Rock, "d": Paper},
+			pairs:   [][2]string{{"a", "b"}, {"c", "d"}},
+			winners: []string{"b", "d"},
+			losers:  []string{"a", "c"},
+		},
+		{
+			name:    "opponent left",
+			shots:   map[string]ShootState{"a": Rock, "c": Paper, "d": Scissors},
+			pairs:   [][2]string{{"a", "b"}, {"c", "d"}},
+			winners: []string{"a", "d"},
+			losers:  []string{"c"},
+		},
+		{
+			name:    "drawn matchup replays",
+			shots:   map[string]ShootState{"a": Rock, "b": Rock, "c": Paper, "d": Rock},
+			pairs:   [][2]string{{"a", "b"}, {"c", "d"}},
+			winners: []string{"a", "b", "c"},
+			losers:  []string{"d"},
+		},
+		{
+			name:       "every matchup drawn",
+			shots:      map[string]ShootState{"a": Rock, "b": Rock, "c": None},
+			pairs:      [][2]string{{"a", "b"}},
+			winners:    []string{"a", "b", "c"},
+			drawReason: drawSame,
+		},
+		{
+			name:       "nobody shot",
+			shots:      map[string]ShootState{"a": None, "b": None, "c": None, "d": None},
+			pairs:      [][2]string{{"a", "b"}, {"c", "d"}},
+			winners:    []string{"a", "b", "c", "d"},
+			drawReason: drawNoShots,
+		},
+	}
+	for _, tt := range tests {
+		room := newRoom(t.Name(), roomOptions{mode: ClassicMode, bracket: true})
+		room.activePlayers = make(map[string]*Client)
+		for id, shot := range tt.shots {
+			member := newTestMember(id)
+			member.shootState = shot
+			room.activePlayers[id] = member
+		}
+		room.opponents = make(map[string]string)
+		for _, pair := range tt.pairs {
+			room.opponents[pair[0]] = pair[1]
+			room.opponents[pair[1]] = pair[0]
+		}
+
+		winners, losers, drawReason := room.determineBracketResults()
+		if got := byMemberID(winners); !reflect.DeepEqual(got, tt.winners) {
+			t.Errorf("%s: winners = %v, want %v", tt.name, got, tt.winners)
+		}
+		if got := byMemberID(losers); !reflect.DeepEqual(got, tt.losers) {
+			t.Errorf("%s: losers = %v, want %v", tt.name, got, tt.losers)
+		}
+		if drawReason != tt.drawReason {
+			t.Errorf("%s: draw reason = %q, want %q", tt.name, drawReason, tt.drawReason)
+		}
+	}
+}
+
+func byMemberID(clients []*Client) []string {
+	var ids []string
+	for _, client := range clients {
+		ids = append(ids, client.id)
+	}
+	return ids
+}
@@ -0,0 +1,26 @@
+package main
+
+// Close codes sent when the server hangs up on a client. Codes 4000-4999
+// are left to applications by RFC 6455, so clients can tell these apart
+// and show the player why they were disconnected. Refusals before the
+// upgrade (shutdown, -max-connections, a bad origin) can only be plain
+// HTTP errors.
+const (
+	// closeJoinTimeout: the connection didn't join a room within
+	// -join-timeout.
+	closeJoinTimeout = 4000
+	// closeSlowClient: the client fell so far behind that its send buffer
+	// filled up.
+	closeSlowClient = 4001
+	// closeRoomClosed: the client's room was closed, either for being
+	// idle or by an administrator.
+	closeRoomClosed = 4002
+	// closeReplaced: the client's session was resumed on a newer
+	// connection.
+	closeReplaced = 4003
+	// closeTooManyInvalid: the client kept sending messages that were
+	// malformed or failed validation.
+	closeTooManyInvalid = 4004
+	// closeKicked: the room's owner kicked the client out.
+	closeKicked = 4005
+)
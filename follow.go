@@ -0,0 +1,109 @@
+package main
+
+// FollowMsg picks the player a spectator follows; an empty id stops.
+type FollowMsg struct {
+	Follow string `json:"follow"`
+}
+
+// handleFollow lets a spectator, such as a caster, see each result from one
+// player's point of view.
+func (c *Client) handleFollow(msg FollowMsg) {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	if !c.spectator {
+		c.sendError("not_spectator", "")
+		return
+	}
+	if !room.follow(c, msg.Follow) {
+		c.sendError("unknown_peer", "")
+		return
+	}
+	c.reply(marshal(map[string]interface{}{"following": msg.Follow}))
+}
+
+func (r *Room) follow(spectator *Client, target string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if target == "" {
+		delete(r.following, spectator.id)
+		return true
+	}
+	if _, exists := r.clients[target]; !exists {
+		return false
+	}
+	r.following[spectator.id] = target
+	return true
+}
+
+// unfollowLocked tells the spectators following a departing player that
+// they've lost their target. Must be called with r.lock held.
+func (r *Room) unfollowLocked(target string) {
+	for id, followed := range r.following {
+		if followed != target {
+			continue
+		}
+		delete(r.following, id)
+		if spectator, exists := r.spectators[id]; exists {
+			spectator.enqueue(marshal(map[string]interface{}{"follow": "target_left"}))
+		}
+	}
+}
+
+// broadcastResult sends a result to the whole room. Spectators following a
+// player get it with focusResult set to how that player fared.
+func (r *Room) broadcastResult(res ResultMsg, winners, losers []*Client) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	plain := marshal(res)
+	for _, client := range r.clients {
+		client.enqueue(plain)
+	}
+	r.sendSpectatorResultLocked(res, plain, winners, losers)
+}
+
+func (r *Room) sendSpectatorResult(res ResultMsg, winners, losers []*Client) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	r.sendSpectatorResultLocked(res, marshal(res), winners, losers)
+}
+
+// sendSpectatorResultLocked must be called with r.lock held.
+func (r *Room) sendSpectatorResultLocked(res ResultMsg, plain []byte, winners, losers []*Client) {
+	r.relayLocked(plain)
+	for id, spectator := range r.spectators {
+		target, following := r.following[id]
+		if !following {
+			spectator.enqueue(plain)
+			continue
+		}
+		focused := res
+		focused.FocusResult = focusResult(res, target, winners, losers)
+		spectator.enqueue(marshal(focused))
+	}
+}
+
+// focusResult says how the player fared in the result, or "" if they
+// weren't part of it.
+func focusResult(res ResultMsg, playerID string, winners, losers []*Client) string {
+	switch {
+	case res.Result == "draw":
+		return "draw"
+	case res.Result == "final_win" && res.Winner == playerID:
+		return "win"
+	case res.Result == "final_win":
+		return "lose"
+	}
+	for _, winner := range winners {
+		if winner.id == playerID {
+			return "win"
+		}
+	}
+	for _, loser := range losers {
+		if loser.id == playerID {
+			return "lose"
+		}
+	}
+	return ""
+}
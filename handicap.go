@@ -0,0 +1,77 @@
+package main
+
+const maxHandicap = 5
+
+// handleHandicap lets the owner make a player win several rounds before
+// the players they beat are knocked out, to even up games between players
+// of different strength. A handicap of 1 removes it.
+func (c *Client) handleHandicap(msg HandicapMsg) {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	if !room.isOwner(c) {
+		c.sendError("not_owner", "")
+		return
+	}
+	if state, _ := room.gameState(); state != Waiting {
+		c.sendError("game_in_progress", "")
+		return
+	}
+	if !room.setHandicap(msg.Handicap.Player, msg.Handicap.Wins) {
+		c.sendError("unknown_peer", "")
+	}
+}
+
+func (r *Room) setHandicap(clientID string, wins int) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.clients[clientID]; !exists {
+		return false
+	}
+	if wins == 1 {
+		delete(r.handicap, clientID)
+	} else {
+		r.handicap[clientID] = wins
+	}
+	handicap := make(map[string]int, len(r.handicap))
+	for id, wins := range r.handicap {
+		handicap[id] = wins
+	}
+	r.broadcastLocked(marshal(map[string]interface{}{"handicap": handicap}))
+	return true
+}
+
+// landsHitLocked counts a round won by winners towards their handicaps and
+// reports whether the round's losers are knocked out: they are as soon as
+// one winner has no handicap or has now won enough rounds. Must be called
+// with r.lock held.
+func (r *Room) landsHitLocked(winners []*Client) bool {
+	landed := false
+	for _, winner := range winners {
+		needed := r.handicap[winner.id]
+		if needed <= 1 {
+			landed = true
+			continue
+		}
+		r.handicapWins[winner.id]++
+		if r.handicapWins[winner.id] >= needed {
+			landed = true
+		}
+	}
+	if landed {
+		// Progress was against players who are now gone
+		r.handicapWins = make(map[string]int)
+	}
+	return landed
+}
+
+// handicapProgressLocked copies the rounds each handicapped player has won
+// towards their next knockout. Must be called with r.lock held.
+func (r *Room) handicapProgressLocked() map[string]int {
+	progress := make(map[string]int, len(r.handicapWins))
+	for id, wins := range r.handicapWins {
+		progress[id] = wins
+	}
+	return progress
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+// TestHandicapHeadsUp plays two games between a handicapped player, who
+// must win two rounds to knock their opponent out, and one who needs one.
+func TestHandicapHeadsUp(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	alice.sendf(`{"handicap":{"player":%q,"wins":2}}`, alice.id)
+	bob.waitFor(fields{"handicap": map[string]int{alice.id: 2}})
+
+	// A win short of the handicap leaves the opponent in, and the second
+	// one knocks them out
+	startGame(t, alice, bob)
+	alice.shoot("rock")
+	bob.shoot("scissors")
+	for _, player := range players {
+		player.waitFor(fields{"result": "round_win", "winners": []string{alice.id}, "losers": []string{bob.id}, "standings": map[string]int{alice.id: 1}})
+		player.waitFor(fields{"shoot": "go"})
+	}
+	alice.shoot("paper")
+	bob.shoot("rock")
+	for _, player := range players {
+		player.waitFor(fields{"result": "final_win", "winner": alice.id})
+	}
+
+	// The handicap carries over, but progress starts again. The player
+	// without one knocks the other out with a single win.
+	startGame(t, alice, bob)
+	alice.shoot("rock")
+	bob.shoot("scissors")
+	for _, player := range players {
+		player.waitFor(fields{"result": "round_win", "standings": map[string]int{alice.id: 1}})
+		player.waitFor(fields{"shoot": "go"})
+	}
+	alice.shoot("rock")
+	bob.shoot("paper")
+	for _, player := range players {
+		player.waitFor(fields{"result": "final_win", "winner": bob.id})
+	}
+}
+
+func TestHandicapOnlyByOwnerBeforeGame(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+
+	bob.sendf(`{"handicap":{"player":%q,"wins":2}}`, alice.id)
+	bob.expectNext(fields{"error": "not_owner"})
+	alice.send(`{"handicap":{"player":"nobody","wins":2}}`)
+	alice.expectNext(fields{"error": "unknown_peer"})
+	startGame(t, alice, bob)
+	alice.sendf(`{"handicap":{"player":%q,"wins":2}}`, bob.id)
+	alice.expectNext(fields{"error": "game_in_progress"})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRoundHistory bounds how many rounds a room remembers; a long game
+// keeps only its most recent ones.
+const maxRoundHistory = 100
+
+// RoundResult records how one round went. Outcomes maps each player who
+// took part to "win", "lose", "draw" or "timeout".
+type RoundResult struct {
+	Round    int                   `json:"round"`
+	At       time.Time             `json:"at"`
+	Choices  map[string]ShootState `json:"choices"`
+	Outcomes map[string]string     `json:"outcomes"`
+}
+
+// recordRound appends a resolved round to the history. idle players didn't
+// shoot in time; a round without losers or idle players is a draw.
+func (r *Room) recordRound(choices map[string]ShootState, winners, losers, idle []*Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	outcomes := make(map[string]string, len(winners)+len(losers)+len(idle))
+	winOutcome := "win"
+	if len(losers) == 0 && len(idle) == 0 {
+		winOutcome = "draw"
+	}
+	for _, client := range winners {
+		outcomes[client.id] = winOutcome
+	}
+	for _, client := range losers {
+		outcomes[client.id] = "lose"
+	}
+	for _, client := range idle {
+		outcomes[client.id] = "timeout"
+	}
+	r.history = append(r.history, RoundResult{Round: r.round, At: time.Now(), Choices: choices, Outcomes: outcomes})
+	if len(r.history) > maxRoundHistory {
+		r.history = r.history[len(r.history)-maxRoundHistory:]
+	}
+}
+
+func (r *Room) roundHistory() []RoundResult {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	history := make([]RoundResult, len(r.history))
+	copy(history, r.history)
+	return history
+}
+
+func roomHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	room := hub.lookupRoom(mux.Vars(r)["id"])
+	if room == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "room_not_found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, room.roundHistory())
+}
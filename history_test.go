@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func getHistory(t *testing.T, srv *httptest.Server, roomID string) []RoundResult {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/rooms/" + roomID + "/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var history []RoundResult
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
+
+// TestHistoryResetsEachGame checks that the history holds the rounds of
+// the game in play and is cleared when it ends.
+func TestHistoryResetsEachGame(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	alice, bob, carol := players[0], players[1], players[2]
+	startGame(t, players...)
+
+	alice.shoot("rock")
+	bob.shoot("rock")
+	carol.shoot("scissors")
+	alice.waitFor(fields{"shoot": "go"})
+	history := getHistory(t, srv, t.Name())
+	if len(history) != 1 {
+		t.Fatalf("history has %d rounds, want 1", len(history))
+	}
+	want := RoundResult{
+		Round:    1,
+		Choices:  map[string]ShootState{alice.id: Rock, bob.id: Rock, carol.id: Scissors},
+		Outcomes: map[string]string{alice.id: "win", bob.id: "win", carol.id: "lose"},
+	}
+	if got := history[0]; got.Round != want.Round || !reflect.DeepEqual(got.Choices, want.Choices) || !reflect.DeepEqual(got.Outcomes, want.Outcomes) {
+		t.Fatalf("round = %+v, want %+v", got, want)
+	}
+
+	alice.shoot("paper")
+	bob.shoot("rock")
+	alice.waitFor(fields{"result": "final_win", "winner": alice.id})
+	// The room is reset just after the result goes out
+	eventually(t, "history cleared", func() bool { return len(getHistory(t, srv, t.Name())) == 0 })
+}
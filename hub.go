@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errAlreadyInRoom  = errors.New("client already in room")
+	errRoomFull       = errors.New("room is full")
+	errSpectatorsFull = errors.New("room has no room for more spectators")
+	errServerFull     = errors.New("room limit reached")
+	errWatchersFull   = errors.New("room has no room for more watchers")
+
+	errNotEnoughPlayers = errors.New("not enough players")
+	errCannotStart      = errors.New("no one to play against")
+
+	errNotPlaying      = errors.New("no game in play")
+	errNotActivePlayer = errors.New("not an active player")
+	errTooEarly        = errors.New("round not accepting shots yet")
+	errInvalidShoot    = errors.New("not a legal choice")
+	errAlreadyShot     = errors.New("already shot this round")
+)
+
+// Hub owns the global room registry. Lock ordering is always hub.lock before
+// room.lock.
+type Hub struct {
+	lock    sync.RWMutex
+	rooms   map[string]*Room
+	clients map[string]*Client
+	wg      sync.WaitGroup
+	// sessions maps session tokens to the client holding that identity
+	sessions map[string]*Client
+
+	// lobby holds the clients watching room events; lobbyLock is a leaf
+	// lock so events can be sent with the hub or a room locked
+	lobbyLock sync.Mutex
+	lobby     map[string]*Client
+}
+
+func newHub() *Hub {
+	return &Hub{
+		rooms:    make(map[string]*Room),
+		clients:  make(map[string]*Client),
+		sessions: make(map[string]*Client),
+		lobby:    make(map[string]*Client),
+	}
+}
+
+// register tracks every connected client, whether or not it has joined a
+// room, so shutdown can reach all of them.
+func (h *Hub) register(c *Client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.clients[c.id] = c
+	h.wg.Add(1)
+	clientsGauge.Set(float64(len(h.clients)))
+}
+
+func (h *Hub) unregister(c *Client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.clients[c.id] == c {
+		delete(h.clients, c.id)
+		h.wg.Done()
+		clientsGauge.Set(float64(len(h.clients)))
+	}
+	h.unsubscribeLobby(c)
+}
+
+// shutdown tells every client the server is going away, closes their
+// connections and waits for them to drain or for ctx to expire.
+func (h *Hub) shutdown(ctx context.Context) error {
+	res := marshal(map[string]interface{}{"server": "shutting_down"})
+	h.lock.RLock()
+	for _, client := range h.clients {
+		client.enqueue(res)
+		client.closeSendWith(websocket.CloseGoingAway, "server shutting down")
+	}
+	h.lock.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// Out of time: stop waiting on slow peers to take their queues
+		h.lock.RLock()
+		for _, client := range h.clients {
+			client.cancel()
+		}
+		h.lock.RUnlock()
+		return ctx.Err()
+	}
+}
+
+func (h *Hub) lookupRoom(roomID string) *Room {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.rooms[roomID]
+}
+
+// joinRoom looks up or creates the room and adds the client to it while
+// holding the hub lock, so the room can't be deleted in between.
+func (h *Hub) joinRoom(roomID, password string, opts roomOptions, c *Client, s seat) (*Room, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	room, exists := h.rooms[roomID]
+	if !exists {
+		var err error
+		if room, err = h.createRoom(roomID, opts); err != nil {
+			return nil, err
+		}
+	} else if c.bot == nil && !room.hasClient(c) && !room.admits(password) {
+		// Bots are only ever added by the owner, who is already inside
+		return nil, errBadPassword
+	}
+	if err := room.addClient(c, s); err != nil {
+		if !exists {
+			h.deleteRoom(roomID)
+		}
+		return nil, err
+	}
+	if !c.spectator {
+		h.notifyLobby("player_count_changed", room.summary())
+	}
+	return room, nil
+}
+
+// createRoom refuses once maxRooms are open so clients can't exhaust memory
+// by joining made-up ids. Must be called with h.lock held.
+func (h *Hub) createRoom(roomID string, opts roomOptions) (*Room, error) {
+	if *maxRooms > 0 && len(h.rooms) >= *maxRooms {
+		return nil, errServerFull
+	}
+	room := newRoom(roomID, opts)
+	h.rooms[roomID] = room
+	roomsGauge.Set(float64(len(h.rooms)))
+	h.notifyLobby("room_created", room.summary())
+	emitEvent("room_created", roomID, map[string]interface{}{"mode": room.gameMode})
+	return room, nil
+}
+
+// deleteRoomIfEmpty removes the room from the registry once its last client
+// has left.
+func (h *Hub) deleteRoomIfEmpty(roomID string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	room, exists := h.rooms[roomID]
+	if !exists || !room.isEmpty() {
+		return
+	}
+	h.deleteRoom(roomID)
+}
+
+// deleteRoom must be called with h.lock held.
+func (h *Hub) deleteRoom(roomID string) {
+	if room, exists := h.rooms[roomID]; exists {
+		room.closeCurrentRound()
+		room.stopReveal()
+		room.closeRematch()
+		room.broadcastWatchers(marshal(map[string]interface{}{"spectate": "room_closed", "room": roomID}))
+		h.notifyLobby("room_removed", roomID)
+		emitEvent("room_closed", roomID, nil)
+	}
+	delete(h.rooms, roomID)
+	roomsGauge.Set(float64(len(h.rooms)))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iceServer matches RTCIceServer so the list can be passed straight to
+// new RTCPeerConnection.
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+func iceConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"iceServers": iceServers(time.Now())})
+}
+
+func iceServers(now time.Time) []iceServer {
+	servers := []iceServer{}
+	var stun []string
+	for _, url := range strings.Split(*stunURLs, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			stun = append(stun, url)
+		}
+	}
+	if len(stun) > 0 {
+		servers = append(servers, iceServer{URLs: stun})
+	}
+	if *turnURL != "" {
+		turn := iceServer{URLs: []string{*turnURL}, Username: *turnUser, Credential: *turnCred}
+		if *turnSecret != "" {
+			turn.Username, turn.Credential = turnCredentials(*turnSecret, *turnUser, now.Add(*turnTTL))
+		}
+		servers = append(servers, turn)
+	}
+	return servers
+}
+
+// turnCredentials issues credentials for the TURN REST API scheme that
+// coturn's use-auth-secret understands: the username is the expiry time and
+// the password is an HMAC of it, so the shared secret never leaves the
+// server and leaked credentials stop working on their own. A configured
+// user is appended after the expiry for coturn's logs.
+func turnCredentials(secret, user string, expires time.Time) (username, password string) {
+	username = strconv.FormatInt(expires.Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,38 @@
+package main
+
+import "time"
+
+// invalidResetRun is how many valid messages in a row wipe out a client's
+// invalid count.
+const invalidResetRun = 5
+
+// noteInvalid counts a message that was malformed or failed validation.
+// A client that sends more than -invalid-limit of them within
+// -invalid-window is told so and disconnected. Only the read pump calls it.
+func (c *Client) noteInvalid() {
+	if *invalidLimit <= 0 || c.kicked {
+		return
+	}
+	now := time.Now()
+	c.validRun = 0
+	if now.Sub(c.invalidSince) > *invalidWindow {
+		c.invalidSince = now
+		c.invalidCount = 0
+	}
+	c.invalidCount++
+	if c.invalidCount <= *invalidLimit {
+		return
+	}
+	c.kicked = true
+	c.connLogger().Warn("Too many invalid messages, closing client", "event", "too_many_invalid", "count", c.invalidCount)
+	c.sendError("too_many_invalid", "")
+	c.closeSendWith(closeTooManyInvalid, "too many invalid messages")
+}
+
+// noteValid counts a message that made it past decoding and validation.
+func (c *Client) noteValid() {
+	c.validRun++
+	if c.validRun >= invalidResetRun {
+		c.invalidCount = 0
+	}
+}
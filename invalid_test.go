@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestTooManyInvalidMessages(t *testing.T) {
+	defer setFlag(invalidLimit, 3)()
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+
+	for i := 0; i < 3; i++ {
+		client.send(`not json`)
+		client.expectNext(fields{"error": "invalid_message"})
+	}
+	client.send(`{"shoot":"fire"}`)
+	client.expectNext(fields{"error": "invalid_shoot"})
+	client.expectNext(fields{"error": "too_many_invalid"})
+	if code := client.expectClosed(); code != closeTooManyInvalid {
+		t.Fatalf("close code = %d, want %d", code, closeTooManyInvalid)
+	}
+}
+
+// TestValidRunResetsInvalidCount checks that a client which gets back on
+// track isn't held to its earlier mistakes.
+func TestValidRunResetsInvalidCount(t *testing.T) {
+	defer setFlag(invalidLimit, 3)()
+	defer setFlag(chatRate, 0)()
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+	client.join(t.Name())
+	client.expectNext(fields{"players": withLength(1)})
+	chat := fields{"chat": fields{"from": client.id, "name": client.id[:8], "text": "sorry"}}
+
+	for i := 0; i < 3; i++ {
+		client.send(`not json`)
+		client.expectNext(fields{"error": "invalid_message"})
+	}
+	for i := 0; i < invalidResetRun; i++ {
+		client.send(`{"chat":"sorry"}`)
+		client.expectNext(chat)
+	}
+	for i := 0; i < 3; i++ {
+		client.send(`not json`)
+		client.expectNext(fields{"error": "invalid_message"})
+	}
+	client.send(`{"chat":"sorry"}`)
+	client.expectNext(chat)
+}
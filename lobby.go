@@ -0,0 +1,63 @@
+package main
+
+// The lobby streams room lifecycle events to clients browsing for a game,
+// so they don't have to poll GET /rooms. Subscribers aren't in any room and
+// take no part in games.
+
+type LobbyMsg struct {
+	Lobby bool `json:"lobby"`
+}
+
+// LobbyEventMsg carries a room's summary, or just its id once removed.
+type LobbyEventMsg struct {
+	Lobby string      `json:"lobby"`
+	Room  interface{} `json:"room"`
+}
+
+type LobbyRoomsMsg struct {
+	Lobby string        `json:"lobby"`
+	Rooms []roomSummary `json:"rooms"`
+}
+
+// handleLobby subscribes the client with {"lobby":true}, sending the current
+// room list first, and unsubscribes it with {"lobby":false}.
+func (c *Client) handleLobby(msg LobbyMsg) {
+	if !msg.Lobby {
+		hub.unsubscribeLobby(c)
+		return
+	}
+	hub.lock.RLock()
+	defer hub.lock.RUnlock()
+	// Under the hub lock no room can be created or removed between the
+	// snapshot and the subscription, so no event is missed
+	c.reply(marshal(LobbyRoomsMsg{Lobby: "rooms", Rooms: hub.roomSummariesLocked()}))
+	hub.lobbyLock.Lock()
+	defer hub.lobbyLock.Unlock()
+	hub.lobby[c.id] = c
+}
+
+func (h *Hub) unsubscribeLobby(c *Client) {
+	h.lobbyLock.Lock()
+	defer h.lobbyLock.Unlock()
+	if h.lobby[c.id] == c {
+		delete(h.lobby, c.id)
+	}
+}
+
+func (h *Hub) inLobby(c *Client) bool {
+	h.lobbyLock.Lock()
+	defer h.lobbyLock.Unlock()
+	return h.lobby[c.id] == c
+}
+
+func (h *Hub) notifyLobby(event string, room interface{}) {
+	h.lobbyLock.Lock()
+	defer h.lobbyLock.Unlock()
+	if len(h.lobby) == 0 {
+		return
+	}
+	res := marshal(LobbyEventMsg{Lobby: event, Room: room})
+	for _, client := range h.lobby {
+		client.enqueue(res)
+	}
+}
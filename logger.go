@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogger installs a JSON slog handler as the default logger, so the
+// standard log package is routed through it as well.
+func setupLogger(level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})))
+	return nil
+}
+
+// logger tags entries with the client's room. c.roomID belongs to the read
+// pump, so code running anywhere else uses connLogger.
+func (c *Client) logger() *slog.Logger {
+	return slog.With("client_id", c.id, "room_id", c.roomID)
+}
+
+func (c *Client) connLogger() *slog.Logger {
+	return slog.With("client_id", c.id)
+}
+
+func (r *Room) logger() *slog.Logger {
+	return slog.With("room_id", r.id)
+}
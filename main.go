@@ -1,68 +1,443 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var addr = flag.String("addr", ":3000", "HTTP service address")
+var (
+	addr              = flag.String("addr", ":3000", "HTTP service address")
+	originList        = flag.String("allowed-origins", "", "comma-separated list of origins allowed to open websockets and call the REST API (empty allows same-origin only)")
+	allowAllOrigins   = flag.Bool("insecure-allow-all-origins", false, "with no -allowed-origins, let any site open websockets and call the REST API")
+	reconnectGrace    = flag.Duration("reconnect-grace", 30*time.Second, "how long a dropped player's seat is held for reconnect (0 disables)")
+	pauseOnDisconnect = flag.Bool("pause-on-disconnect", false, "pause a heads-up game while a dropped player's seat is held for reconnect")
+	tlsCert           = flag.String("tls-cert", "", "TLS certificate file; serves wss when set together with -tls-key")
+	tlsKey            = flag.String("tls-key", "", "TLS private key file")
+	redirectAddr      = flag.String("http-redirect", "", "plain HTTP address that redirects to the TLS listener (requires TLS)")
+	messageRate       = flag.Float64("rate-limit", 20, "messages per second each client may send (0 disables)")
+	messageBurst      = flag.Int("rate-burst", 40, "burst size for the per-client message rate limit")
+	invalidLimit      = flag.Int("invalid-limit", 20, "invalid messages a client may send within -invalid-window before it is disconnected (0 disables)")
+	invalidWindow     = flag.Duration("invalid-window", time.Minute, "window over which -invalid-limit is counted")
+	chatRate          = flag.Float64("chat-rate-limit", 1, "chat messages per second each client may send (0 disables)")
+	chatBurst         = flag.Int("chat-burst", 5, "burst size for the per-client chat rate limit")
+	roomTTL           = flag.Duration("room-ttl", 30*time.Minute, "close rooms idle for this long (0 disables)")
+	reapInterval      = flag.Duration("reap-interval", time.Minute, "how often to look for idle rooms")
+	logLevel          = flag.String("log-level", "info", "log level: debug, info, warn or error")
+	minPlayers        = flag.Int("min-players", 2, "minimum number of players needed to start a game")
+	maxPlayers        = flag.Int("max-players", 8, "maximum number of players per room")
+	maxSpectators     = flag.Int("max-spectators", 100, "maximum number of spectators per room, not counting players (0 disables)")
+	maxRooms          = flag.Int("max-rooms", 10000, "maximum number of rooms open at once (0 disables)")
+	countdownFrom     = flag.Int("countdown", 3, "seconds counted down before each round accepts shots")
+	roundTimeout      = flag.Duration("round-timeout", 10*time.Second, "time players have to shoot each round (0 disables)")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for connections to drain on shutdown")
+	timeoutPolicy     = flag.String("timeout-policy", "eliminate", `what happens to players who don't shoot in time: "eliminate" or "random"`)
+	rematchTimeout    = flag.Duration("rematch-timeout", 30*time.Second, "how long rematch votes stay open after a game ends")
+	stunURLs          = flag.String("stun-urls", "stun:stun.l.google.com:19302", "comma-separated STUN server URLs handed to clients")
+	turnURL           = flag.String("turn-url", "", "TURN server URL handed to clients (empty disables TURN)")
+	turnUser          = flag.String("turn-user", os.Getenv("TURN_USER"), "static TURN username (defaults to $TURN_USER)")
+	turnCred          = flag.String("turn-cred", os.Getenv("TURN_CRED"), "static TURN credential (defaults to $TURN_CRED)")
+	turnSecret        = flag.String("turn-secret", os.Getenv("TURN_SECRET"), "shared secret for time-limited TURN credentials, used instead of -turn-user/-turn-cred (defaults to $TURN_SECRET)")
+	turnTTL           = flag.Duration("turn-ttl", 12*time.Hour, "lifetime of generated TURN credentials")
+	readBuffer        = flag.Int("read-buffer", 1024, "websocket read buffer size in bytes")
+	writeBuffer       = flag.Int("write-buffer", 1024, "websocket write buffer size in bytes")
+	adminToken        = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token for the /admin endpoints, which are disabled when empty (defaults to $ADMIN_TOKEN)")
+	joinTimeout       = flag.Duration("join-timeout", 15*time.Second, "how long a new connection has to join a room before it is closed")
+	gameSeed          = flag.Int64("seed", 0, "seed for each room's random choices, for reproducible games (0 seeds from the clock)")
+	revealDelay       = flag.Duration("reveal-delay", 0, "how long the result of a round everyone has shot in is held back, for client animations")
+	allowShotChange   = flag.Bool("allow-shot-change", false, "let players change their shot until the round resolves")
+	maxConnections    = flag.Int64("max-connections", 10000, "maximum number of open websocket connections (0 disables)")
+	showVersion       = flag.Bool("version", false, "print the build version and exit")
+	sendBuffer        = flag.Int("send-buffer", 256, "messages queued for a client before it counts as too slow")
+	slowClient        = flag.String("slow-client", "disconnect", `what happens when a client's send buffer is full: "disconnect" or "drop" the message`)
+	webhookURL        = flag.String("webhook-url", "", "URL that room events are POSTed to as JSON (empty disables)")
+	compression       = flag.Bool("compression", false, "negotiate permessage-deflate with clients that support it, mostly to shrink relayed SDP")
+	compressionLevel  = flag.Int("compression-level", flate.BestSpeed, "deflate level from -2 (Huffman only) to 9 (best compression) when -compression is set")
+	maxMessageSize    = flag.Int64("max-message-size", 64*1024, "largest message in bytes a client may send before being disconnected")
+	maxSpectate       = flag.Int("max-spectate", 4, "maximum number of rooms one connection can watch with spectate")
+	maxWatchers       = flag.Int("max-watchers", 100, "maximum number of connections watching one room with spectate (0 disables)")
+)
 
 var (
-	rooms          = make(map[string]*Room)
-	roomReadyState = make(map[string]map[string]bool)
-	upgrader       = websocket.Upgrader{
+	hub      = newHub()
+	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+		CheckOrigin:     checkOrigin,
 	}
 )
 
+// openConnections counts connections, including upgrades in progress,
+// against -max-connections.
+var openConnections atomic.Int64
+
 const (
-	writeWait = 10 * time.Second
+	writeWait     = 10 * time.Second
+	maxNameLength = 32
+	maxChatLength = 500
+	pongWait      = 60 * time.Second
+	pingPeriod    = 30 * time.Second
+	countdownStep = time.Second
 )
 
 type RoomState int
 type ShootState int
+type GameMode string
 
 const (
 	Waiting RoomState = iota
 	Playing
+	// Paused is a game waiting for a dropped player; see pause.go
+	Paused
 )
 
+func (s RoomState) String() string {
+	switch s {
+	case Waiting:
+		return "waiting"
+	case Playing:
+		return "playing"
+	case Paused:
+		return "paused"
+	}
+	return "unknown"
+}
+
 const (
 	None ShootState = iota
 	Rock
 	Paper
 	Scissors
+	Lizard
+	Spock
 )
 
+const (
+	ClassicMode     GameMode = "rps"
+	LizardSpockMode GameMode = "rpsls"
+)
+
+const (
+	defaultBestOfRounds = 3
+	maxBestOfRounds     = 99
+)
+
+// roomOptions are fixed when a room is created. Zero values fall back to the
+// server-wide flags.
+type roomOptions struct {
+	mode GameMode
+	// roundsToWin switches the room to best-of-N play when non-zero
+	roundsToWin int
+	// bracket plays each round as 1-vs-1 matchups
+	bracket    bool
+	maxPlayers int
+	// maxSpectators caps spectators separately from maxPlayers
+	maxSpectators int
+	roundTimeout  time.Duration
+	// allowShotChange overrides -allow-shot-change when set
+	allowShotChange *bool
+	tieBreak        string
+	// password makes the room invite-only when non-empty
+	password string
+	// autoStart begins the game as soon as the room is full
+	autoStart bool
+}
+
+// parseRoomMode turns a mode name, which may be "bestof" with an optional
+// round count or "bracket", into room options.
+func parseRoomMode(mode string, rounds *int) (roomOptions, error) {
+	var opts roomOptions
+	if mode == "bracket" {
+		opts.mode = ClassicMode
+		opts.bracket = true
+		return opts, nil
+	}
+	if mode == "bestof" {
+		opts.mode = ClassicMode
+		opts.roundsToWin = defaultBestOfRounds
+		if rounds != nil {
+			if *rounds < 1 || *rounds > maxBestOfRounds {
+				return roomOptions{}, fmt.Errorf("rounds must be a whole number between 1 and %d", maxBestOfRounds)
+			}
+			opts.roundsToWin = *rounds
+		}
+		return opts, nil
+	}
+	var ok bool
+	opts.mode, ok = parseGameMode(mode)
+	if !ok {
+		return roomOptions{}, errors.New("unknown mode")
+	}
+	return opts, nil
+}
+
+// beatTable lists the choices each choice defeats. Classic rooms simply never
+// see Lizard or Spock, so one table serves both modes.
+var beatTable = map[ShootState][]ShootState{
+	Rock:     {Scissors, Lizard},
+	Paper:    {Rock, Spock},
+	Scissors: {Paper, Lizard},
+	Lizard:   {Spock, Paper},
+	Spock:    {Scissors, Rock},
+}
+
+// beats reports whether choice a defeats choice b.
+func beats(a, b ShootState) bool {
+	for _, defeated := range beatTable[a] {
+		if defeated == b {
+			return true
+		}
+	}
+	return false
+}
+
+// survivingChoices splits the choices thrown in a round into the ones no
+// other thrown choice beats and the ones that are beaten. The round is a
+// draw when either side comes back empty.
+func survivingChoices(thrown []ShootState) (surviving, beaten []ShootState) {
+	for _, choice := range thrown {
+		isBeaten := false
+		for _, other := range thrown {
+			if beats(other, choice) {
+				isBeaten = true
+				break
+			}
+		}
+		if isBeaten {
+			beaten = append(beaten, choice)
+		} else {
+			surviving = append(surviving, choice)
+		}
+	}
+	return surviving, beaten
+}
+
+func (m GameMode) choices() []ShootState {
+	if m == LizardSpockMode {
+		return []ShootState{Rock, Paper, Scissors, Lizard, Spock}
+	}
+	return []ShootState{Rock, Paper, Scissors}
+}
+
+func (m GameMode) isValidChoice(choice ShootState) bool {
+	for _, legal := range m.choices() {
+		if choice == legal {
+			return true
+		}
+	}
+	return false
+}
+
+func parseGameMode(mode string) (GameMode, bool) {
+	switch GameMode(mode) {
+	case "", ClassicMode:
+		return ClassicMode, true
+	case LizardSpockMode:
+		return LizardSpockMode, true
+	}
+	return "", false
+}
+
 type Client struct {
-	id         string
-	conn       *websocket.Conn
-	shootState ShootState
-	roomID     string
+	id        string
+	name      string
+	spectator bool
+	// session lets the client reclaim its identity after a dropped
+	// connection; graceTimer is set while its seat is being held
+	session    string
+	graceTimer *time.Timer
+
+	limiter             *tokenBucket
+	chatLimiter         *tokenBucket
+	lastRateLimitNotice time.Time
+	// requestID is the id of the message being handled, echoed on replies
+	// to it. Only the read pump touches it.
+	requestID json.RawMessage
+	// Invalid messages are tracked by the read pump; see invalid.go
+	invalidCount int
+	invalidSince time.Time
+	validRun     int
+	kicked       bool
+	conn         *websocket.Conn
+	shootState   ShootState
+	roomID       string
+	// spectating holds the rooms watched with spectate, apart from roomID.
+	// Only the read pump touches it.
+	spectating map[string]bool
+
+	send     chan []byte
+	sendLock sync.Mutex
+	closed   bool
+	// closeFrame is written by the write pump once send is closed
+	closeFrame []byte
+	// seq numbers every frame sent on this connection so the client can
+	// spot drops and reordering
+	seq atomic.Uint64
+	// bot is set for server-run players, which have no connection; their
+	// send queue is consumed by runBot instead of a write pump
+	bot botStrategy
+	// ctx is cancelled once the connection is torn down, or by the server
+	// to force it down without waiting for the queue to flush
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed once the read pump has finished tearing the
+	// connection down. replaced is set when a reconnect is taking over
+	// the session, so the teardown leaves the seat for it.
+	done     chan struct{}
+	replaced atomic.Bool
 }
 
 func (c *Client) readPump() {
-	defer c.conn.Close()
+	// graceful is set when the client hung up on purpose rather than
+	// dropping, so its seat isn't held for a reconnect
+	graceful := false
+	defer func() {
+		// The write pump sends the close frame and then closes the
+		// connection
+		c.closeSend()
+		hub.unregister(c)
+		c.unwatchAll()
+		c.disconnect(graceful)
+		openConnections.Add(-1)
+		close(c.done)
+	}()
+	// gorilla answers an oversized frame with a 1009 close and ErrReadLimit
+	c.conn.SetReadLimit(*maxMessageSize)
+	// Until the client joins a room it gets joinTimeout, and pongs don't
+	// extend it; after that the heartbeat keeps the connection alive
+	awaitingJoin := c.roomID == ""
+	if awaitingJoin {
+		c.conn.SetReadDeadline(time.Now().Add(*joinTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	}
+	c.conn.SetPongHandler(func(string) error {
+		if !awaitingJoin {
+			c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		}
+		return nil
+	})
+	// Echo the client's close frame through the write pump to complete the
+	// closing handshake after whatever is still queued
+	c.conn.SetCloseHandler(func(code int, text string) error {
+		c.closeSendWith(code, "")
+		return nil
+	})
 	for {
 		_, message, err := c.conn.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			c.logger().Warn("Message too large", "event", "message_too_large", "limit", *maxMessageSize)
+			return
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && awaitingJoin {
+			c.logger().Info("No join before the deadline", "event", "join_timeout")
+			c.sendError("join_timeout", "")
+			c.closeSendWith(closeJoinTimeout, "join timeout")
+			return
+		}
 		if err != nil {
-			log.Println("Read error:", err)
-			c.leaveRoom()
+			graceful = websocket.IsCloseError(err, websocket.CloseNormalClosure)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger().Warn("Connection dropped", "event", "disconnect", "error", err)
+			} else {
+				c.logger().Info("Connection closed", "event", "disconnect", "error", err)
+			}
 			return
 		}
 		c.handleMessage(message)
+		if c.kicked {
+			// Kicked clients aren't held a seat to come back to
+			graceful = true
+			return
+		}
+		if awaitingJoin && (c.roomID != "" || len(c.spectating) > 0 || hub.inLobby(c)) {
+			awaitingJoin = false
+			c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		}
+	}
+}
+
+// writePump is the only goroutine allowed to write to the connection. It
+// also pings the peer so readPump's deadline trips on dead connections.
+//
+// A failed write means the connection is dead. The send queue is closed so
+// broadcasts stop piling up for the client, and closing the connection
+// fails readPump's read, which takes the client out of its room through the
+// usual disconnect path rather than from under a broadcast.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.closeSend()
+		c.conn.Close()
+		c.cancel()
+	}()
+	logger := c.connLogger()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case message, ok := <-c.send:
+			if !ok {
+				c.writeMessage(websocket.CloseMessage, c.closeFrame)
+				return
+			}
+			if err := c.writeMessage(websocket.TextMessage, withSeq(message, c.seq.Add(1))); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					// A peer that can't take a message in writeWait is
+					// stalled, not just behind
+					slowClients.Inc()
+					logger.Warn("Write timed out, closing client", "event", "slow_client", "error", err)
+					return
+				}
+				logger.Warn("Write error", "event", "write_failed", "error", err)
+				return
+			}
+		case <-ticker.C:
+			if err := c.writeMessage(websocket.PingMessage, nil); err != nil {
+				logger.Warn("Ping error", "event", "write_failed", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// withSeq adds a "seq" field to a JSON object. The message may be shared
+// with other clients by a broadcast, so a copy is returned.
+func withSeq(message []byte, seq uint64) []byte {
+	if len(message) < 2 || message[0] != '{' {
+		return message
+	}
+	out := make([]byte, 0, len(message)+24)
+	out = append(out, `{"seq":`...)
+	out = strconv.AppendUint(out, seq, 10)
+	if message[1] != '}' {
+		out = append(out, ',')
 	}
+	return append(out, message[1:]...)
 }
 
 func (c *Client) writeMessage(messageType int, data []byte) error {
@@ -70,263 +445,759 @@ func (c *Client) writeMessage(messageType int, data []byte) error {
 	return c.conn.WriteMessage(messageType, data)
 }
 
-func (c *Client) handleMessage(message []byte) {
-	var data map[string]interface{}
-	if err := json.Unmarshal(message, &data); err != nil {
-		log.Println("Unmarshal error:", err)
+// enqueue hands a message to the write pump. A client whose buffer is full
+// is too slow to keep up: by default its send channel is closed and the
+// write pump hangs up on it, or with -slow-client=drop the message is
+// thrown away.
+func (c *Client) enqueue(message []byte) {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	if c.closed {
 		return
 	}
+	select {
+	case c.send <- message:
+	default:
+		if *slowClient == "drop" {
+			droppedMessages.Inc()
+			return
+		}
+		slowClients.Inc()
+		c.connLogger().Warn("Send buffer full, closing client", "event", "slow_client")
+		c.closed = true
+		c.closeFrame = websocket.FormatCloseMessage(closeSlowClient, "send buffer full")
+		close(c.send)
+	}
+}
 
-	switch {
-	case data["join"] != nil:
-		c.handleJoin(data["join"].(string))
-	case data["offer"] != nil:
-		c.handleOffer(data)
-	case data["answer"] != nil:
-		c.handleAnswer(data)
-	case data["ice"] != nil:
-		c.handleIce(data)
-	case data["leave"] != nil:
-		c.handleLeave()
-	case data["fight"] != nil:
-		c.handleFight()
-	case data["shoot"] != nil:
-		c.handleShoot(data)
-	}
-}
-
-func (c *Client) handleJoin(roomID string) {
-	c.roomID = roomID
-	room := getOrCreateRoom(roomID)
+func (c *Client) closeSend() {
+	c.closeSendWith(websocket.CloseNormalClosure, "")
+}
+
+// closeSendWith closes the send channel so the write pump flushes what's
+// queued and then hangs up with the given close code.
+func (c *Client) closeSendWith(code int, text string) {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.closeFrame = websocket.FormatCloseMessage(code, text)
+		close(c.send)
+	}
+}
 
-	if room.hasClient(c) {
-		log.Println("Client already in room:", roomID)
+func (c *Client) handleMessage(message []byte) {
+	now := time.Now()
+	if !c.limiter.allow(now) {
+		// Tell the client once a second at most, or the warnings become
+		// the flood
+		if now.Sub(c.lastRateLimitNotice) >= time.Second {
+			c.lastRateLimitNotice = now
+			c.sendError("rate_limited", "")
+		}
 		return
 	}
-	room.addClient(c)
-	log.Printf("Client %s joined room %s", c.id, roomID)
 
-	// Notify existing clients about the new client
-	res, _ := json.Marshal(map[string]interface{}{"new": c.id})
-	room.broadcastExcept(res, c)
+	msgType, raw, id, err := decodeMessage(message)
+	c.requestID = id
+	defer func() { c.requestID = nil }()
+	if err != nil {
+		c.logger().Warn("Invalid message", "error", err)
+		c.sendError("invalid_message", err.Error())
+		c.noteInvalid()
+		return
+	}
 
-	// Send joined confirmation to the client
-	res, _ = json.Marshal(map[string]interface{}{"joined": c.id})
-	c.writeMessage(websocket.TextMessage, res)
+	defer func() {
+		if room := hub.lookupRoom(c.roomID); room != nil {
+			room.touch()
+		}
+	}()
+
+	c.dispatch(msgType, raw, message)
+}
+
+// dispatch runs the handler for the message, turning a panic into an
+// internal error for this message alone rather than losing the connection.
+func (c *Client) dispatch(msgType string, raw, message []byte) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.logger().Error("Handler panicked", "event", "handler_panic", "type", msgType, "message", string(message), "error", err, "stack", string(debug.Stack()))
+			c.sendError("internal", "")
+		}
+	}()
+	messageHandlers[msgType](c, raw)
+}
+
+// sendError is the single path for reporting a failed request back to the
+// client.
+func (c *Client) sendError(code, detail string) {
+	c.reply(marshal(ErrorMsg{Error: code, Detail: detail}))
+}
+
+// currentRoom returns the room the client has joined, or replies with an
+// error and returns nil if there is none.
+func (c *Client) currentRoom() *Room {
+	room := c.memberRoom()
+	if room == nil {
+		c.logger().Debug("No room joined")
+		c.sendError("not_in_room", "")
+	}
+	return room
 }
 
-func (c *Client) handleOffer(data map[string]interface{}) {
+// memberRoom returns the room the client is still a member of, if any. A
+// kick takes the client out of the room from the owner's goroutine, which
+// can't touch c.roomID, so the read pump forgets the room here instead.
+func (c *Client) memberRoom() *Room {
 	if c.roomID == "" {
-		log.Println("No room joined")
+		return nil
+	}
+	room := hub.lookupRoom(c.roomID)
+	if room == nil || !room.hasClient(c) {
+		c.roomID = ""
+		return nil
+	}
+	return room
+}
+
+// handleJoin adds the client to the room. The mode and rounds only apply
+// when the join creates the room.
+func (c *Client) handleJoin(msg JoinMsg) {
+	// JoinMsg is shared with matchmake, which has no room to name
+	if msg.Join == "" {
+		c.sendValidationError([]fieldError{{Field: "join", Problem: "must be a non-empty string"}})
 		return
 	}
-	room := rooms[c.roomID]
-	offer, _ := json.Marshal(data)
-	toClientID := data["to"].(string)
-	room.sendToClient(toClientID, offer)
+	opts, s, ok := c.parseJoin(msg)
+	if !ok {
+		return
+	}
+	previous, wasSpectator := c.roomID, c.spectator
+	room, err := hub.joinRoom(msg.Join, msg.Password, opts, c, s)
+	if err == nil && previous != "" {
+		// A client plays in one room at a time. It only leaves the old one
+		// once the new one has let it in, so a refused join costs nothing.
+		c.leave(previous, wasSpectator)
+	}
+	c.completeJoin(msg.Join, room, err)
 }
 
-func (c *Client) handleAnswer(data map[string]interface{}) {
-	if c.roomID == "" {
-		log.Println("No room joined")
+// seat is who a client joins a room as. It only takes effect once the room
+// has let the client in, so a refused join leaves the client as it was.
+type seat struct {
+	name      string
+	spectator bool
+}
+
+// parseJoin reads the room options, display name and role shared by join
+// and matchmake. The message has already been validated.
+func (c *Client) parseJoin(msg JoinMsg) (roomOptions, seat, bool) {
+	opts, err := parseRoomMode(msg.Mode, msg.Rounds)
+	if err != nil {
+		c.sendError("invalid_message", err.Error())
+		return roomOptions{}, seat{}, false
+	}
+	name := sanitizeName(msg.Name)
+	if name == "" {
+		name = c.id[:8]
+	}
+	return opts, seat{name: name, spectator: msg.Role == "spectator"}, true
+}
+
+// sendJoinError tells the client why hub.joinRoom turned it away.
+func (c *Client) sendJoinError(err error) {
+	switch err {
+	case errAlreadyInRoom:
+		c.sendError("already_in_room", "")
+	case errRoomFull:
+		c.sendError("room_full", "")
+	case errSpectatorsFull:
+		c.sendError("spectators_full", "")
+	case errServerFull:
+		c.sendError("server_full", "")
+	case errBadPassword:
+		c.sendError("bad_password", "")
+	default:
+		c.sendError("join_failed", err.Error())
+	}
+}
+
+// completeJoin reports the outcome of a join attempt and, on success,
+// introduces the client to the room.
+func (c *Client) completeJoin(roomID string, room *Room, err error) {
+	switch err {
+	case nil:
+	case errAlreadyInRoom:
+		slog.Debug("Client already in room", "client_id", c.id, "room_id", roomID)
+	case errRoomFull:
+		slog.Info("Room is full", "event", "join_rejected", "client_id", c.id, "room_id", roomID)
+	case errSpectatorsFull:
+		slog.Info("No room for more spectators", "event", "join_rejected", "client_id", c.id, "room_id", roomID)
+	case errServerFull:
+		slog.Warn("Room limit reached", "event", "join_rejected", "client_id", c.id, "room_id", roomID)
+	case errBadPassword:
+		slog.Info("Wrong room password", "event", "join_rejected", "client_id", c.id, "room_id", roomID)
+	default:
+		slog.Warn("Join error", "client_id", c.id, "room_id", roomID, "error", err)
+	}
+	if err != nil {
+		c.sendJoinError(err)
 		return
 	}
-	room := rooms[c.roomID]
-	answer, _ := json.Marshal(data)
-	toClientID := data["to"].(string)
-	room.sendToClient(toClientID, answer)
+	c.roomID = roomID
+	c.logger().Info("Client joined room", "event", "join")
+
+	// Notify existing clients about the new client
+	room.broadcastExcept(marshal(NewClientMsg{New: c.id, Name: c.name, Role: c.role()}), c)
+
+	// Send joined confirmation to the client
+	state, activePlayers := room.gameState()
+	c.reply(marshal(JoinedMsg{
+		Joined:        c.id,
+		Room:          roomID,
+		Name:          c.name,
+		Role:          c.role(),
+		Session:       c.session,
+		Owner:         room.owner(),
+		State:         state.String(),
+		ActivePlayers: activePlayers,
+	}))
+
+	// Give the client the full roster so it doesn't have to build one from
+	// join events
+	c.enqueue(marshal(PlayersMsg{Players: room.players()}))
+
+	if !c.spectator {
+		room.autoStartIfFull()
+	}
 }
 
-func (c *Client) handleIce(data map[string]interface{}) {
-	if c.roomID == "" {
-		log.Println("No room joined")
+func (c *Client) role() string {
+	if c.spectator {
+		return "spectator"
+	}
+	return "player"
+}
+
+// sanitizeName strips control characters so a display name can't mess with
+// other players' UIs.
+func sanitizeName(name string) string {
+	return stripControl(name)
+}
+
+func stripControl(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// handleSignal relays a WebRTC offer, answer or ICE candidate to the peer
+// named in "to". Both ends must be in the room, and "from" is always set by
+// the server so a peer can't be impersonated.
+func (c *Client) handleSignal(msg SignalMsg) {
+	room := c.currentRoom()
+	if room == nil {
 		return
 	}
-	room := rooms[c.roomID]
-	ice, _ := json.Marshal(data)
-	room.broadcastExcept(ice, c)
+	if msg.To == "" || msg.To == c.id || !room.hasClient(c) {
+		c.sendError("unknown_peer", "")
+		return
+	}
+	msg.Fields["from"] = marshal(c.id)
+	if !room.sendToClient(msg.To, marshal(msg.Fields)) {
+		c.sendError("unknown_peer", "")
+	}
 }
 
 func (c *Client) handleLeave() {
 	c.leaveRoom()
 }
 
-func (c *Client) handleFight() {
-	if c.roomID == "" {
-		log.Println("No room joined")
+// handleFight marks the client ready and starts the game once everyone is.
+// The owner can send {"fight":"force"} to start with whoever is ready.
+func (c *Client) handleFight(msg FightMsg) {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	if c.spectator {
+		c.sendError("spectators_cannot_play", "")
 		return
 	}
 
-	room := rooms[c.roomID]
-
-	if room.activePlayers != nil && room.activePlayers[c.id] == nil {
-		log.Println("Client not an active player:", c.id)
+	if room.isSittingOut(c.id) {
+		c.logger().Debug("Client not an active player")
+		c.sendError("not_active_player", "")
+		return
+	}
+	force := msg.Fight == "force"
+	if force && !room.isOwner(c) {
+		c.sendError("not_owner", "")
+		return
+	}
+	if state, _ := room.gameState(); state != Waiting {
+		c.sendError("game_in_progress", "")
 		return
 	}
-	roomReadyState[c.roomID][c.id] = true
+	room.setReady(c.id, true)
 
-	if room.allReady() {
-		res, _ := json.Marshal(map[string]interface{}{"fight": "start"})
-		room.state = Playing
-		room.initActivePlayers()
-		room.broadcast(res)
+	started, err := room.tryStart(force)
+	if err != nil {
+		c.sendStartError(err)
+		return
+	}
+	if started {
+		room.startGame()
 	} else {
-		res, _ := json.Marshal(map[string]interface{}{"fight": "waiting"})
-		room.broadcastExcept(res, c)
+		ready, notReady := room.readyState()
+		room.broadcastExcept(marshal(FightWaitingMsg{Fight: "waiting", NotReady: notReady, Ready: ready}), c)
 	}
 }
 
-func (c *Client) handleShoot(data map[string]interface{}) {
-	if c.roomID == "" {
-		log.Println("No room joined")
+// sendStartError tells the client why tryStart refused to start the game.
+func (c *Client) sendStartError(err error) {
+	switch err {
+	case errCannotStart:
+		c.sendError("cannot_start", "a game needs at least two players")
+	case errNotEnoughPlayers:
+		c.sendError("not_enough_players", fmt.Sprintf("at least %d players are needed", *minPlayers))
+	}
+}
+
+func (c *Client) handleShoot(msg ShootMsg) {
+	room := c.currentRoom()
+	if room == nil {
 		return
 	}
-	room := rooms[c.roomID]
-	if room == nil || room.state != Playing {
-		log.Println("Room not in playing state:", c.roomID)
+	if c.spectator {
+		c.sendError("spectators_cannot_play", "")
 		return
 	}
-
-	if room.activePlayers[c.id] == nil {
-		log.Println("Client not an active player:", c.id)
+	round, err := room.recordShot(c.id, msg.Shoot)
+	switch err {
+	case nil:
+	case errNotPlaying:
+		c.logger().Debug("Room not in playing state")
+		c.sendError("not_playing", "")
+		return
+	case errNotActivePlayer:
+		c.logger().Debug("Client not an active player")
+		c.sendError("not_active_player", "")
+		return
+	case errTooEarly:
+		c.sendError("too_early", "")
+		return
+	case errInvalidShoot:
+		c.sendError("invalid_shoot", fmt.Sprintf("%d is not a legal choice in %s mode", msg.Shoot, room.gameMode))
+		return
+	case errAlreadyShot:
+		c.sendError("already_shot", "")
 		return
 	}
+	c.reply(marshal(ShotMsg{Shot: "accepted", Choice: msg.Shoot}))
 
-	shootValue := ShootState(int(data["shoot"].(float64)))
-	room.setClientShootState(c.id, shootValue)
-
-	if room.allActivePlayersShot() {
-		winners, losers := room.determineWinnersAndLosers()
-		fmt.Println("Who survived:", room.activePlayers)
-		room.updateActivePlayers(winners)
-		fmt.Println("Winners:", winners)
-		fmt.Println("Losers:", losers)
+	if !room.allActivePlayersShot() {
+		// Only the sender hears about this, so nobody learns anything about
+		// the other players' choices
+		c.enqueue(marshal(ShotMsg{Shot: "waiting_for_others"}))
+		return
+	}
+	// The timer may have settled the round and opened the next one since
+	// the shot, and that round isn't this player's to close
+	if room.closeRound(round) {
+		room.revealRound()
+	}
+}
 
-		if len(winners) == len(room.activePlayers) && len(losers) == 0 {
-			// All players drew, no one is eliminated
-			res, _ := json.Marshal(map[string]interface{}{"result": "draw"})
-			room.resetForNextRound()
-			room.broadcast(res)
-		} else if len(room.activePlayers) == 1 {
-			// Final winner
-			finalWinner := room.getFinalWinner()
-			res, _ := json.Marshal(map[string]interface{}{"result": "final_win", "winner": finalWinner.id})
-			room.broadcast(res)
-			room.resetForNextGame()
-		} else {
-			// Some players are eliminated, proceed to next round
-			// Inform each client about their status
-			for _, client := range room.clients {
-				var res []byte
-				if _, isWinner := room.activePlayers[client.id]; isWinner {
-					res, _ = json.Marshal(map[string]interface{}{"result": "win"})
-				} else if containsClient(losers, client) {
-					res, _ = json.Marshal(map[string]interface{}{"result": "lose"})
-				}
-				client.writeMessage(websocket.TextMessage, res)
-			}
-			room.resetForNextRound()
-		}
+// handleChat relays a chat line to everyone in the room, spectators
+// included, whatever the game state.
+func (c *Client) handleChat(msg ChatMsg) {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	text := stripControl(msg.Chat)
+	if text == "" {
+		return
+	}
+	if !c.chatLimiter.allow(time.Now()) {
+		c.sendError("chat_rate_limited", "")
+		return
 	}
+
+	room.broadcast(marshal(ChatOutMsg{Chat: ChatLine{From: c.id, Name: c.name, Text: text}}))
 }
 
+// leaveRoom takes the client out of its room. It may run more than once for
+// the same departure, say for a leave message followed by the socket
+// dropping; only the call that actually removes the client announces it
+// and tidies up the room.
 func (c *Client) leaveRoom() {
 	if c.roomID == "" {
 		return
 	}
-	room := rooms[c.roomID]
-	if room == nil {
+	c.leave(c.roomID, c.spectator)
+	c.roomID = ""
+}
+
+// leave takes the client out of a room it was in as a player, or as a
+// spectator if spectator is set. It doesn't touch c.roomID, which may
+// already name the client's next room.
+func (c *Client) leave(roomID string, spectator bool) {
+	room := hub.lookupRoom(roomID)
+	if room == nil || !room.removeClient(c) {
 		return
 	}
-	room.removeClient(c)
-	log.Printf("Client %s left room %s", c.id, c.roomID)
-	c.roomID = ""
+	if !spectator {
+		hub.notifyLobby("player_count_changed", room.summary())
+	}
+	if c.bot == nil {
+		room.removeBotsIfAlone()
+	}
+	room.reevaluateRound()
+	hub.deleteRoomIfEmpty(room.id)
+	slog.Info("Client left room", "event", "leave", "client_id", c.id, "room_id", roomID)
 }
 
 type Room struct {
 	id            string
 	clients       map[string]*Client
+	spectators    map[string]*Client
 	state         RoomState
 	lock          sync.RWMutex
 	activePlayers map[string]*Client
+	maxPlayers    int
+	maxSpectators int
+	roundTimeout  time.Duration
+	gameMode      GameMode
+	// ownerID is the player allowed to force-start the game
+	ownerID string
+	// joinOrder numbers players in the order they joined, so ownership
+	// passes to whoever has been here longest
+	joinOrder map[string]uint64
+	joinSeq   uint64
+	// ready marks the players who have sent fight for the next start
+	ready  map[string]bool
+	scores map[string]int
+
+	// roundsToWin is non-zero in best-of-N rooms, where roundWins tracks
+	// each player's progress through the current match
+	roundsToWin int
+	roundWins   map[string]int
+
+	// bracket rooms pair players off each round; opponents maps each
+	// player to who they face this round. See bracket.go.
+	bracket   bool
+	opponents map[string]string
+
+	// handicap holds the rounds a player must win before the players they
+	// beat are eliminated; handicapWins is their progress towards it
+	handicap     map[string]int
+	handicapWins map[string]int
+
+	// lastActivity is bumped by every message from a member and by state
+	// changes; the reaper closes rooms where it gets too old
+	lastActivity time.Time
+
+	round          int
+	roundOpen      bool
+	acceptingShots bool
+	roundTimer     *time.Timer
+	// shot marks the players who have shot this round, apart from their
+	// choice, which the timeout policy can also fill in
+	shot            map[string]bool
+	allowShotChange bool
+	// tieBreak decides what a standoff leads to; reshoot is set while the
+	// current round is being shot again because of one
+	tieBreak string
+	reshoot  bool
+
+	// password is nil for public rooms; it never changes once set
+	password  *roomPassword
+	autoStart bool
+	// revealTimer is set while a closed round's result is held back
+	revealTimer *time.Timer
+
+	// following maps a spectator to the player whose results it follows
+	following map[string]string
+	// pausedFor is the player a Paused game is waiting for
+	pausedFor string
+	// watchers follow the room from outside it; see spectate.go
+	watchers map[string]*Client
+
+	// rematchVotes is non-nil while a rematch vote is open after a game
+	rematchVotes map[string]bool
+	rematchRound int
+	rematchTimer *time.Timer
+
+	history []RoundResult
+
+	// rng is guarded by rngLock, a leaf lock, so it can be used with or
+	// without r.lock held
+	rng     *rand.Rand
+	rngLock sync.Mutex
 }
 
-func getOrCreateRoom(roomID string) *Room {
-	room, exists := rooms[roomID]
-	if !exists {
-		room = &Room{
-			id:      roomID,
-			clients: make(map[string]*Client),
-			state:   Waiting,
-		}
-		rooms[roomID] = room
-		roomReadyState[roomID] = make(map[string]bool)
+func newRoom(roomID string, opts roomOptions) *Room {
+	room := &Room{
+		id:              roomID,
+		clients:         make(map[string]*Client),
+		spectators:      make(map[string]*Client),
+		scores:          make(map[string]int),
+		roundWins:       make(map[string]int),
+		handicap:        make(map[string]int),
+		handicapWins:    make(map[string]int),
+		following:       make(map[string]string),
+		watchers:        make(map[string]*Client),
+		joinOrder:       make(map[string]uint64),
+		ready:           make(map[string]bool),
+		state:           Waiting,
+		lastActivity:    time.Now(),
+		maxPlayers:      *maxPlayers,
+		maxSpectators:   *maxSpectators,
+		roundTimeout:    *roundTimeout,
+		allowShotChange: *allowShotChange,
+		gameMode:        opts.mode,
+		roundsToWin:     opts.roundsToWin,
+		bracket:         opts.bracket,
+		rng:             newRoomRNG(),
+	}
+	if opts.maxPlayers > 0 {
+		room.maxPlayers = opts.maxPlayers
+	}
+	if opts.maxSpectators > 0 {
+		room.maxSpectators = opts.maxSpectators
+	}
+	if opts.roundTimeout > 0 {
+		room.roundTimeout = opts.roundTimeout
+	}
+	if opts.allowShotChange != nil {
+		room.allowShotChange = *opts.allowShotChange
+	}
+	room.tieBreak = opts.tieBreak
+	room.autoStart = opts.autoStart
+	if opts.password != "" {
+		room.password = newRoomPassword(opts.password)
 	}
 	return room
 }
 
-func (r *Room) addClient(c *Client) {
+func newRoomRNG() *rand.Rand {
+	seed := *gameSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// intn draws from the room's generator, which every random game decision
+// goes through so a fixed -seed replays the same way.
+func (r *Room) intn(n int) int {
+	r.rngLock.Lock()
+	defer r.rngLock.Unlock()
+	return r.rng.Intn(n)
+}
+
+// addClient seats the client, taking on the name and role it asked for.
+func (r *Room) addClient(c *Client, s seat) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	if r.hasClientLocked(c.id) {
+		return errAlreadyInRoom
+	}
+	if s.spectator {
+		if r.maxSpectators > 0 && len(r.spectators) >= r.maxSpectators {
+			return errSpectatorsFull
+		}
+		c.name, c.spectator = s.name, true
+		r.spectators[c.id] = c
+		return nil
+	}
+	if r.maxPlayers > 0 && len(r.clients) >= r.maxPlayers {
+		return errRoomFull
+	}
+	c.name, c.spectator = s.name, false
 	r.clients[c.id] = c
-	roomReadyState[r.id][c.id] = false
+	r.joinSeq++
+	r.joinOrder[c.id] = r.joinSeq
+	if r.ownerID == "" {
+		r.ownerID = c.id
+	}
+	r.ready[c.id] = false
+	return nil
 }
 
-func (r *Room) removeClient(c *Client) {
+// removeClient drops the client from the room and tells everyone left. The
+// hub only deletes the room afterwards, so the leave is always announced.
+// It reports false if the client wasn't there, which includes a held seat
+// that a reconnect has since taken over under the same id.
+func (r *Room) removeClient(c *Client) bool {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	if r.clients[c.id] != c && r.spectators[c.id] != c {
+		return false
+	}
+	_, wasPlayer := r.clients[c.id]
 	delete(r.clients, c.id)
-	delete(roomReadyState[r.id], c.id)
-	if len(r.clients) == 0 {
-		delete(rooms, r.id)
-		delete(roomReadyState, r.id)
+	delete(r.spectators, c.id)
+	delete(r.activePlayers, c.id)
+	delete(r.scores, c.id)
+	delete(r.roundWins, c.id)
+	delete(r.handicap, c.id)
+	delete(r.handicapWins, c.id)
+	delete(r.following, c.id)
+	delete(r.ready, c.id)
+	delete(r.joinOrder, c.id)
+
+	r.broadcastLocked(marshal(map[string]interface{}{"left": c.id}))
+
+	if wasPlayer {
+		r.unfollowLocked(c.id)
+	}
+	if wasPlayer && r.rematchVotes != nil {
+		// The remaining players didn't agree to this lineup, so they vote
+		// again
+		r.resetRematchVotesLocked()
+		r.broadcastRematchLocked()
+	}
+
+	if r.ownerID == c.id {
+		r.ownerID = r.successorLocked()
+		if r.ownerID != "" {
+			r.broadcastLocked(marshal(map[string]interface{}{"owner": r.ownerID}))
+		}
 	}
+	return true
 }
 
-func (r *Room) hasClient(c *Client) bool {
+// gameState reports whether a game is underway and who is still in it, so a
+// late joiner knows to show a waiting view.
+func (r *Room) gameState() (RoomState, []string) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
-	_, exists := r.clients[c.id]
-	return exists
+	activePlayers := make([]string, 0, len(r.activePlayers))
+	for id := range r.activePlayers {
+		activePlayers = append(activePlayers, id)
+	}
+	sort.Strings(activePlayers)
+	return r.state, activePlayers
 }
 
-func (r *Room) broadcast(message []byte) {
+func (r *Room) owner() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.ownerID
+}
+
+// isSittingOut reports whether a game's roster has been drawn up without the
+// client.
+func (r *Room) isSittingOut(clientID string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.activePlayers != nil && r.activePlayers[clientID] == nil
+}
+
+func (r *Room) isOwner(c *Client) bool {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
+	return r.ownerID == c.id
+}
+
+type playerInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Bot  bool   `json:"bot,omitempty"`
+}
+
+func (r *Room) players() []playerInfo {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	players := make([]playerInfo, 0, len(r.clients))
 	for _, client := range r.clients {
-		client.writeMessage(websocket.TextMessage, message)
+		players = append(players, playerInfo{ID: client.id, Name: client.name, Bot: client.bot != nil})
 	}
+	sort.Slice(players, func(i, j int) bool { return players[i].ID < players[j].ID })
+	return players
 }
 
-func (r *Room) broadcastExcept(message []byte, exclude *Client) {
+func (r *Room) isEmpty() bool {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
+	return len(r.clients) == 0 && len(r.spectators) == 0
+}
+
+func (r *Room) hasClient(c *Client) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.hasClientLocked(c.id)
+}
+
+func (r *Room) hasClientLocked(clientID string) bool {
+	_, isPlayer := r.clients[clientID]
+	_, isSpectator := r.spectators[clientID]
+	return isPlayer || isSpectator
+}
+
+// broadcast queues the message for everyone in the room. The members are
+// copied under the lock and sent to after releasing it, so joins and leaves
+// aren't held up by the fan-out.
+func (r *Room) broadcast(message []byte) {
+	for _, member := range r.members() {
+		member.enqueue(message)
+	}
+	r.relay(message)
+}
+
+func (r *Room) broadcastLocked(message []byte) {
 	for _, client := range r.clients {
-		if client.id != exclude.id {
-			client.writeMessage(websocket.TextMessage, message)
+		client.enqueue(message)
+	}
+	for _, spectator := range r.spectators {
+		spectator.enqueue(message)
+	}
+	r.relayLocked(message)
+}
+
+func (r *Room) broadcastExcept(message []byte, exclude *Client) {
+	for _, member := range r.members() {
+		if member.id != exclude.id {
+			member.enqueue(message)
 		}
 	}
+	r.relay(message)
 }
 
-func (r *Room) sendToClient(clientID string, message []byte) {
+// sendToClient reports whether clientID is a member of the room.
+func (r *Room) sendToClient(clientID string, message []byte) bool {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
 	if client, exists := r.clients[clientID]; exists {
-		client.writeMessage(websocket.TextMessage, message)
+		client.enqueue(message)
+	} else if spectator, exists := r.spectators[clientID]; exists {
+		spectator.enqueue(message)
+	} else {
+		return false
 	}
+	return true
 }
 
+// allReady must be called with r.lock held.
 func (r *Room) allReady() bool {
 	if r.activePlayers != nil {
 		for clientID := range r.activePlayers {
-			if !roomReadyState[r.id][clientID] {
+			if !r.isReadyLocked(clientID) {
 				return false
 			}
 		}
 		return true
 	} else {
 		for clientID := range r.clients {
-			if !roomReadyState[r.id][clientID] {
+			if !r.isReadyLocked(clientID) {
 				return false
 			}
 		}
@@ -334,23 +1205,124 @@ func (r *Room) allReady() bool {
 	}
 }
 
-func (r *Room) initActivePlayers() {
+func (r *Room) setReady(clientID string, ready bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.clients[clientID]; exists {
+		r.ready[clientID] = ready
+	}
+}
+
+// readyState splits the players who would play the next game, the active
+// players mid-match or everyone otherwise, into ready and not ready.
+func (r *Room) readyState() (ready, notReady []string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	eligible := r.activePlayers
+	if eligible == nil {
+		eligible = r.clients
+	}
+	ready, notReady = []string{}, []string{}
+	for id := range eligible {
+		if r.isReadyLocked(id) {
+			ready = append(ready, id)
+		} else {
+			notReady = append(notReady, id)
+		}
+	}
+	sort.Strings(ready)
+	sort.Strings(notReady)
+	return ready, notReady
+}
+
+// isReadyLocked treats bots as always ready so they never hold up a start.
+// Must be called with r.lock held.
+func (r *Room) isReadyLocked(clientID string) bool {
+	if client, exists := r.clients[clientID]; exists && client.bot != nil {
+		return true
+	}
+	return r.ready[clientID]
+}
+
+// tryStart puts the room into play once every eligible player is ready, or
+// straight away with just the ready players on a forced start. The checks
+// and the switch to Playing happen under one lock so joins and leaves can't
+// slip in between.
+func (r *Room) tryStart(force bool) (bool, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	if r.activePlayers == nil {
-		r.activePlayers = make(map[string]*Client)
-		for id, client := range r.clients {
-			r.activePlayers[id] = client
+	// Whoever got here second, say a fight racing an auto-start, finds the
+	// game already running
+	if r.state != Waiting {
+		return false, nil
+	}
+	if !force && !r.allReady() {
+		return false, nil
+	}
+
+	candidates := r.activePlayers
+	if candidates == nil {
+		candidates = r.clients
+	}
+	activePlayers := make(map[string]*Client, len(candidates))
+	for id, client := range candidates {
+		if !force || r.isReadyLocked(id) {
+			activePlayers[id] = client
 		}
 	}
+	// However the room got here, nobody plays a game alone, even if
+	// -min-players allows it
+	if len(activePlayers) <= 1 {
+		return false, errCannotStart
+	}
+	if len(activePlayers) < *minPlayers {
+		return false, errNotEnoughPlayers
+	}
+	r.activePlayers = activePlayers
+	r.state = Playing
+	r.lastActivity = time.Now()
+	r.closeRematchLocked()
+	r.handicapWins = make(map[string]int)
+	return true, nil
 }
 
-func (r *Room) setClientShootState(clientID string, shootState ShootState) {
+// startGame announces the game along with who is playing in it, so
+// spectators and players who weren't ready know they're sitting it out.
+func (r *Room) startGame() {
+	_, activePlayers := r.gameState()
+	emitEvent("game_started", r.id, map[string]interface{}{"activePlayers": activePlayers})
+	r.broadcast(marshal(map[string]interface{}{"fight": "start", "activePlayers": activePlayers}))
+	r.startRound()
+}
+
+// recordShot sets the player's choice for the round. The round is checked
+// under the same lock the timers settle it with, so a shot can't land in a
+// round that has just timed out or a game that has just ended. Unless the
+// room allows changes, a player who has already shot this round is
+// refused, so nobody can wait to see what happens and then switch. It
+// returns the round the shot counts in.
+func (r *Room) recordShot(clientID string, shootState ShootState) (int, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	if client, exists := r.activePlayers[clientID]; exists {
-		client.shootState = shootState
+	if r.state != Playing {
+		return 0, errNotPlaying
+	}
+	client, exists := r.activePlayers[clientID]
+	if !exists {
+		return 0, errNotActivePlayer
+	}
+	if !r.acceptingShots {
+		return 0, errTooEarly
 	}
+	if !r.gameMode.isValidChoice(shootState) {
+		return 0, errInvalidShoot
+	}
+	if r.shot[clientID] && !r.allowShotChange {
+		return 0, errAlreadyShot
+	}
+	r.shot[clientID] = true
+	client.shootState = shootState
+	return r.round, nil
 }
 
 func (r *Room) allActivePlayersShot() bool {
@@ -364,59 +1336,446 @@ func (r *Room) allActivePlayersShot() bool {
 	return true
 }
 
-func (r *Room) determineWinnersAndLosers() (winners []*Client, losers []*Client) {
+// Draw reasons reported alongside a draw result.
+const (
+	drawSame     = "same"     // everyone threw the same choice
+	drawStandoff = "standoff" // every choice thrown was beaten by another
+	drawNoShots  = "no_shots" // nobody shot at all
+)
+
+// determineWinnersAndLosers settles the round. When nobody is knocked out
+// every active player is returned as a winner along with why it was a draw.
+// Both slices are sorted by client id, so results come out the same way
+// every time.
+func (r *Room) determineWinnersAndLosers() (winners []*Client, losers []*Client, drawReason string) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
 
+	// A lone player has won whether they shot or not
+	if len(r.activePlayers) == 1 {
+		for _, client := range r.activePlayers {
+			winners = append(winners, client)
+		}
+		return winners, nil, ""
+	}
+
+	// Players who haven't shot take no part; the caller decides what
+	// happens to them
 	choices := make(map[ShootState][]*Client)
 	for _, client := range r.activePlayers {
+		if client.shootState == None {
+			continue
+		}
 		choices[client.shootState] = append(choices[client.shootState], client)
 	}
 
-	// If all made the same choice or all three choices are present, it's a draw
-	if len(choices) == 1 || len(choices) == 3 {
-		// All players proceed to next round
+	thrown := make([]ShootState, 0, len(choices))
+	for choice := range choices {
+		thrown = append(thrown, choice)
+	}
+	surviving, beaten := survivingChoices(thrown)
+	for _, choice := range surviving {
+		winners = append(winners, choices[choice]...)
+	}
+	for _, choice := range beaten {
+		losers = append(losers, choices[choice]...)
+	}
+
+	// If everyone made the same choice or every choice is beaten by another,
+	// it's a draw and all players proceed to next round
+	if len(winners) == 0 || len(losers) == 0 {
 		winners = make([]*Client, 0, len(r.activePlayers))
 		for _, client := range r.activePlayers {
 			winners = append(winners, client)
 		}
-		return winners, nil
+		switch len(thrown) {
+		case 0:
+			drawReason = drawNoShots
+		case 1:
+			drawReason = drawSame
+		default:
+			drawReason = drawStandoff
+		}
+		sortClients(winners)
+		return winners, nil, drawReason
 	}
 
-	// If two choices are present, determine which choice beats the other
-	if len(choices) == 2 {
-		var winningChoice, losingChoice ShootState
+	sortClients(winners)
+	sortClients(losers)
+	return winners, losers, ""
+}
 
-		_, okRock := choices[Rock]
-		_, okPaper := choices[Paper]
-		_, okScissors := choices[Scissors]
+// sortClients orders clients by id.
+func sortClients(clients []*Client) {
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+}
 
-		if okRock && okPaper {
-			winningChoice, losingChoice = Paper, Rock
-		} else if okPaper && okScissors {
-			winningChoice, losingChoice = Scissors, Paper
-		} else if okScissors && okRock {
-			winningChoice, losingChoice = Rock, Scissors
+// startRound opens a new round and kicks off its countdown. A timer left
+// over from a previous round is stopped, and its callback will see a stale
+// round number and do nothing.
+func (r *Room) startRound() {
+	r.lock.Lock()
+	if r.roundTimer != nil {
+		r.roundTimer.Stop()
+		r.roundTimer = nil
+	}
+	if r.state != Playing {
+		// The game was aborted while the last round was being settled
+		r.lock.Unlock()
+		return
+	}
+	if len(r.activePlayers) == 1 {
+		// Everyone else left before the round began. There's nobody to
+		// play against, so the last player wins outright instead of
+		// drawing with themselves.
+		var winner *Client
+		for _, client := range r.activePlayers {
+			winner = client
 		}
+		r.lock.Unlock()
+		r.finishGame(winner, map[string]ShootState{})
+		return
+	}
+	r.round++
+	r.roundOpen = true
+	r.reshoot = false
+	r.shot = make(map[string]bool)
+	r.acceptingShots = false
+	if r.bracket {
+		r.pairPlayersLocked()
+	}
+	round := r.round
+	r.lock.Unlock()
+
+	r.countdown(round, *countdownFrom)
+}
 
-		winners = choices[winningChoice]
-		losers = choices[losingChoice]
-		return winners, losers
+// countdown broadcasts one tick and schedules the next. After the last tick
+// the round accepts shots and its shoot timer is armed. Closing the round
+// stops the chain.
+func (r *Room) countdown(round, n int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.roundOpen || r.round != round {
+		return
 	}
 
-	// Should not reach here
-	return nil, nil
+	var res []byte
+	if n > 0 {
+		res = marshal(map[string]interface{}{"countdown": n})
+		r.roundTimer = time.AfterFunc(countdownStep, func() { r.countdown(round, n-1) })
+	} else {
+		res = marshal(map[string]interface{}{"shoot": "go"})
+		r.acceptingShots = true
+		r.roundTimer = nil
+		if r.roundTimeout > 0 {
+			timeout := r.roundTimeout
+			if r.reshoot {
+				timeout /= 2
+			}
+			r.roundTimer = time.AfterFunc(timeout, func() { r.onRoundTimeout(round) })
+		}
+	}
+	r.broadcastLocked(res)
 }
 
-func (r *Room) updateActivePlayers(winners []*Client) {
+// closeRound marks the given round as resolved. Only the first caller gets
+// true, so a round is resolved exactly once whether by the last shot or by
+// the timer.
+func (r *Room) closeRound(round int) bool {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	return r.closeRoundLocked(round)
+}
 
+func (r *Room) closeCurrentRound() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closeRoundLocked(r.round)
+}
+
+func (r *Room) closeRoundLocked(round int) bool {
+	if !r.roundOpen || r.round != round {
+		return false
+	}
+	r.roundOpen = false
+	r.acceptingShots = false
+	if r.roundTimer != nil {
+		r.roundTimer.Stop()
+		r.roundTimer = nil
+	}
+	return true
+}
+
+func (r *Room) onRoundTimeout(round int) {
+	if !r.closeRound(round) {
+		return
+	}
+	r.logger().Info("Round timed out", "event", "round_timeout", "round", round)
+	r.resolveRound(r.applyTimeoutPolicy())
+}
+
+// applyTimeoutPolicy deals with active players who never shot, returning the
+// ones that lose the round for it. Outside best-of-N they are also
+// eliminated.
+func (r *Room) applyTimeoutPolicy() (idle []*Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	choices := r.gameMode.choices()
+	// Go in id order so a seeded generator hands out the same choices
+	ids := make([]string, 0, len(r.activePlayers))
+	for id := range r.activePlayers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		client := r.activePlayers[id]
+		if client.shootState != None {
+			continue
+		}
+		if *timeoutPolicy == "random" {
+			client.shootState = choices[r.intn(len(choices))]
+			continue
+		}
+		idle = append(idle, client)
+	}
+
+	// If nobody shot there is no one to hand the round to, so replay it
+	if len(idle) == len(r.activePlayers) {
+		return nil
+	}
+	if r.roundsToWin > 0 {
+		return idle
+	}
+	for _, client := range idle {
+		delete(r.activePlayers, client.id)
+	}
+	return idle
+}
+
+// resolveRound settles a closed round. Players in idle didn't shoot in time
+// and count as losers.
+func (r *Room) resolveRound(idle []*Client) {
+	r.settleRound(r.scoreRound(), idle)
+}
+
+func (r *Room) settleRound(outcome roundOutcome, idle []*Client) {
+	choices, winners, losers, drawReason := outcome.choices, outcome.winners, outcome.losers, outcome.drawReason
+	if drawReason == drawStandoff && len(idle) == 0 && r.tieBreak == tieBreakReshoot {
+		r.reshootRound(choices)
+		return
+	}
+	roundsPlayed.Inc()
+	emitEvent("round_resolved", r.id, map[string]interface{}{
+		"winners": clientIDs(winners),
+		"losers":  clientIDs(append(losers, idle...)),
+		"choices": choices,
+	})
+	r.recordRound(choices, winners, losers, idle)
+	if r.roundsToWin > 0 {
+		r.resolveBestOfRound(winners, losers, idle, choices, drawReason)
+		return
+	}
+	losers = append(losers, idle...)
+	progress, spared := r.updateActivePlayers(winners)
+	r.logger().Debug("Round resolved", "event", "round_resolved", "winners", clientIDs(winners), "losers", clientIDs(losers))
+
+	if spared {
+		// A handicapped winner hasn't won enough rounds to knock anyone out
+		res := ResultMsg{Result: "round_win", Winners: clientIDs(winners), Losers: clientIDs(losers), Standings: progress, Choices: choices}
+		r.resetForNextRound()
+		r.broadcastResult(res, winners, losers)
+		r.startRound()
+	} else if r.activeCount() == 1 {
+		// Final winner, which is also how a round ends when everyone else
+		// has disconnected
+		r.finishGame(r.getFinalWinner(), choices)
+	} else if len(winners) == r.activeCount() && len(losers) == 0 {
+		// All players drew, no one is eliminated
+		draws.Inc()
+		res := ResultMsg{Result: "draw", Reason: drawReason, Choices: choices}
+		r.resetForNextRound()
+		r.broadcastResult(res, nil, nil)
+		r.startRound()
+	} else {
+		// Some players are eliminated, proceed to next round
+		r.sendPlayerResults(winners, losers, choices)
+		r.sendSpectatorResult(ResultMsg{Result: "round_over", Winners: clientIDs(winners), Losers: clientIDs(losers), Choices: choices}, winners, losers)
+		// Let everyone see how close the game is to its final, and who is
+		// left in it
+		_, activePlayers := r.gameState()
+		r.broadcast(marshal(map[string]interface{}{"remaining": len(activePlayers), "activePlayers": activePlayers}))
+		r.resetForNextRound()
+		r.startRound()
+	}
+}
+
+// sendPlayerResults tells each player how they did in an elimination round.
+// Those knocked out learn which round it was and who beat them; players
+// knocked out in an earlier round have no result of their own.
+func (r *Room) sendPlayerResults(winners, losers []*Client, choices map[string]ShootState) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, client := range r.clients {
+		var res []byte
+		if _, isWinner := r.activePlayers[client.id]; isWinner {
+			res = marshal(ResultMsg{Result: "win", Name: client.name, Choices: choices})
+		} else if containsClient(losers, client) {
+			by := beatenBy(client, winners, choices)
+			if r.bracket {
+				by = r.opponentLocked(client.id)
+			}
+			res = marshal(ResultMsg{Result: "lose", Name: client.name, Round: r.round, BeatenBy: by, Choices: choices})
+		} else {
+			res = marshal(ResultMsg{Result: "spectating", Choices: choices})
+		}
+		client.enqueue(res)
+	}
+}
+
+// resolveBestOfRound scores a best-of-N round. Nobody is eliminated; each
+// round's winners earn a point and the first to reach roundsToWin takes the
+// match.
+func (r *Room) resolveBestOfRound(winners, losers, idle []*Client, choices map[string]ShootState, drawReason string) {
+	if r.activeCount() == 1 {
+		// Everyone else left
+		r.finishGame(r.getFinalWinner(), choices)
+		return
+	}
+
+	// An idle player can end up among the winners of a drawn round
+	var roundWinners []*Client
+	for _, winner := range winners {
+		if !containsClient(idle, winner) {
+			roundWinners = append(roundWinners, winner)
+		}
+	}
+	losers = append(losers, idle...)
+
+	if len(roundWinners) == 0 || len(losers) == 0 {
+		draws.Inc()
+		res := ResultMsg{Result: "draw", Reason: drawReason, Choices: choices}
+		r.resetForNextRound()
+		r.broadcastResult(res, nil, nil)
+		r.startRound()
+		return
+	}
+
+	standings, champion := r.awardRoundWins(roundWinners)
+	if champion != nil {
+		r.finishGame(champion, choices)
+		return
+	}
+	res := ResultMsg{Result: "round_win", Winners: clientIDs(roundWinners), Standings: standings, Choices: choices}
+	r.resetForNextRound()
+	r.broadcastResult(res, roundWinners, losers)
+	r.startRound()
+}
+
+// awardRoundWins gives each winner a point and returns the standings along
+// with the match champion, if one player alone has reached roundsToWin.
+func (r *Room) awardRoundWins(winners []*Client) (map[string]int, *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, winner := range winners {
+		r.roundWins[winner.id]++
+	}
+
+	standings := make(map[string]int, len(r.activePlayers))
+	var champion *Client
+	best, tied := 0, false
+	for id, client := range r.activePlayers {
+		wins := r.roundWins[id]
+		standings[id] = wins
+		if wins > best {
+			best, champion, tied = wins, client, false
+		} else if wins == best {
+			tied = true
+		}
+	}
+	if best < r.roundsToWin || tied {
+		return standings, nil
+	}
+	return standings, champion
+}
+
+// finishGame announces the match winner along with the deciding round's
+// choices, credits the win and readies the room for the next game.
+func (r *Room) finishGame(winner *Client, choices map[string]ShootState) {
+	gamesFinished.Inc()
+	gamesFinishedTotal.Add(1)
+	emitEvent("game_finished", r.id, map[string]interface{}{"winner": winner.id})
+	r.broadcastResult(ResultMsg{Result: "final_win", Winner: winner.id, Name: winner.name, Choices: choices}, nil, nil)
+	r.broadcast(marshal(map[string]interface{}{"scoreboard": r.recordWin(winner.id)}))
+	r.resetForNextGame()
+	r.openRematch()
+}
+
+// thrownChoices maps each active player who shot this round to their
+// choice. Spectators and players knocked out earlier are left out since
+// they didn't take part.
+func (r *Room) thrownChoices() map[string]ShootState {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	choices := make(map[string]ShootState, len(r.activePlayers))
+	for id, client := range r.activePlayers {
+		if client.shootState != None {
+			choices[id] = client.shootState
+		}
+	}
+	return choices
+}
+
+func (r *Room) activeCount() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.activePlayers)
+}
+
+// reevaluateRound settles the current round if a departure left it decided:
+// everyone still in has shot, or at most one player is left standing.
+func (r *Room) reevaluateRound() {
+	r.lock.RLock()
+	playing := r.state != Waiting && r.activePlayers != nil
+	paused := r.state == Paused
+	remaining := len(r.activePlayers)
+	r.lock.RUnlock()
+	if !playing {
+		return
+	}
+
+	switch {
+	case remaining == 0:
+		r.resetForNextGame()
+	case paused && remaining == 1:
+		// One of the two players left for good, which ends the game
+		if r.unpause() {
+			r.finishGame(r.getFinalWinner(), map[string]ShootState{})
+		}
+	case remaining == 1 || r.allActivePlayersShot():
+		if r.closeCurrentRound() {
+			r.resolveRound(nil)
+		}
+	}
+}
+
+// updateActivePlayers keeps only the round's winners in the game, unless a
+// handicap spares the losers. Then everyone stays in and the handicapped
+// players' progress is returned.
+func (r *Room) updateActivePlayers(winners []*Client) (map[string]int, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(winners) > 0 && len(winners) < len(r.activePlayers) && !r.landsHitLocked(winners) {
+		return r.handicapProgressLocked(), true
+	}
 	newActivePlayers := make(map[string]*Client)
 	for _, winner := range winners {
 		newActivePlayers[winner.id] = winner
 	}
 	r.activePlayers = newActivePlayers
+	return nil, false
 }
 
 func (r *Room) resetForNextRound() {
@@ -424,29 +1783,84 @@ func (r *Room) resetForNextRound() {
 	defer r.lock.Unlock()
 
 	for _, client := range r.activePlayers {
-		roomReadyState[r.id][client.id] = false
+		r.ready[client.id] = false
 		client.shootState = None
 	}
 }
 
+// getFinalWinner returns the last player standing. There should be only
+// one; if a bug left more, the one with the lowest id is picked rather than
+// whichever the map gives up first.
 func (r *Room) getFinalWinner() *Client {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
+	remaining := make([]*Client, 0, len(r.activePlayers))
 	for _, client := range r.activePlayers {
-		return client // There should be only one
+		remaining = append(remaining, client)
 	}
-	return nil
+	if len(remaining) == 0 {
+		return nil
+	}
+	if len(remaining) > 1 {
+		r.logger().Error("More than one player left at the end of the game", "event", "multiple_final_winners", "players", len(remaining))
+	}
+	sortClients(remaining)
+	return remaining[0]
+}
+
+// recordWin credits a game win to the client and returns a copy of the
+// scoreboard.
+func (r *Room) recordWin(clientID string) map[string]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.scores[clientID]++
+	scores := make(map[string]int, len(r.scores))
+	for id, score := range r.scores {
+		scores[id] = score
+	}
+	return scores
 }
 
 func (r *Room) resetForNextGame() {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	r.resetForNextGameLocked()
+}
+
+func (r *Room) resetForNextGameLocked() {
+	r.closeRoundLocked(r.round)
+	r.stopRevealLocked()
 	r.state = Waiting
+	r.pausedFor = ""
+	r.lastActivity = time.Now()
 	r.activePlayers = nil
+	r.roundWins = make(map[string]int)
+	r.history = nil
 	for _, client := range r.clients {
 		client.shootState = None
-		roomReadyState[r.id][client.id] = false
 	}
+	r.ready = make(map[string]bool, len(r.clients))
+}
+
+// beatenBy lists the winners whose choice beat the loser's. A player who
+// never shot wasn't beaten by anyone in particular.
+func beatenBy(loser *Client, winners []*Client, choices map[string]ShootState) []string {
+	var ids []string
+	for _, winner := range winners {
+		if beats(choices[winner.id], choices[loser.id]) {
+			ids = append(ids, winner.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func clientIDs(clients []*Client) []string {
+	ids := make([]string, 0, len(clients))
+	for _, client := range clients {
+		ids = append(ids, client.id)
+	}
+	return ids
 }
 
 func containsClient(clients []*Client, client *Client) bool {
@@ -460,29 +1874,168 @@ func containsClient(clients []*Client, client *Client) bool {
 
 func main() {
 	flag.Parse()
+	if *showVersion {
+		fmt.Println(buildInfo())
+		return
+	}
+	if err := setupLogger(*logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *timeoutPolicy != "eliminate" && *timeoutPolicy != "random" {
+		slog.Error("Unknown timeout policy", "policy", *timeoutPolicy)
+		os.Exit(1)
+	}
+	if *slowClient != "disconnect" && *slowClient != "drop" {
+		slog.Error("Unknown slow client policy", "policy", *slowClient)
+		os.Exit(1)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		slog.Error("Both -tls-cert and -tls-key must be set to enable TLS")
+		os.Exit(1)
+	}
+	if *redirectAddr != "" && !tlsEnabled() {
+		slog.Error("-http-redirect requires TLS to be enabled")
+		os.Exit(1)
+	}
+	allowedOrigins = parseOrigins(*originList)
+	if len(allowedOrigins) == 0 && *allowAllOrigins {
+		slog.Warn("INSECURE: any website can open websockets to this server and act for its visitors; set -allowed-origins in production", "event", "allow_all_origins")
+	}
+	upgrader.ReadBufferSize = *readBuffer
+	upgrader.WriteBufferSize = *writeBuffer
+	if *compressionLevel < flate.HuffmanOnly || *compressionLevel > flate.BestCompression {
+		slog.Error("-compression-level must be between -2 and 9", "level", *compressionLevel)
+		os.Exit(1)
+	}
+	upgrader.EnableCompression = *compression
+	if *roomTTL > 0 && *reapInterval > 0 {
+		go hub.runReaper(*roomTTL, *reapInterval)
+	}
+	if *webhookURL != "" {
+		go webhooks.run(*webhookURL)
+	}
+	srv := &http.Server{Addr: *addr, Handler: newRouter()}
+	go func() {
+		slog.Info("Server started", "addr", *addr, "tls", tlsEnabled(), "version", version, "commit", commit)
+		if err := listen(srv); err != nil && err != http.ErrServerClosed {
+			slog.Error("ListenAndServe", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	var redirectSrv *http.Server
+	if *redirectAddr != "" {
+		redirectSrv = &http.Server{Addr: *redirectAddr, Handler: http.HandlerFunc(redirectHandler)}
+		go func() {
+			slog.Info("Redirect server started", "addr", *redirectAddr)
+			if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("ListenAndServe", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	slog.Info("Shutting down")
+	shuttingDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	// Shutdown doesn't track hijacked websocket connections, so the hub
+	// drains those itself. The listener stays up meanwhile so /readyz can
+	// report the drain.
+	if err := hub.shutdown(ctx); err != nil {
+		slog.Warn("Client drain error", "error", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("Server shutdown error", "error", err)
+	}
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(ctx); err != nil {
+			slog.Warn("Redirect server shutdown error", "error", err)
+		}
+	}
+}
+
+// newRouter wires up every route, so the whole server can be mounted on an
+// httptest.Server as well as the real listener.
+func newRouter() http.Handler {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/", serveWs)
-
-	log.Printf("Server started at %s", *addr)
-	if err := http.ListenAndServe(*addr, r); err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/healthz", healthzHandler).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", readyzHandler).Methods(http.MethodGet)
+	r.HandleFunc("/version", versionHandler).Methods(http.MethodGet)
+	r.HandleFunc("/stats", statsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/rooms", listRoomsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/rooms", createRoomHandler).Methods(http.MethodPost)
+	r.HandleFunc("/rooms/{id}", getRoomHandler).Methods(http.MethodGet)
+	r.HandleFunc("/rooms/{id}/history", roomHistoryHandler).Methods(http.MethodGet)
+	r.HandleFunc("/clients/{id}", getClientHandler).Methods(http.MethodGet)
+	r.HandleFunc("/matchmake", matchmakeHandler).Methods(http.MethodGet)
+	r.HandleFunc("/ice-config", iceConfigHandler).Methods(http.MethodGet)
+	r.HandleFunc("/admin/rooms/{id}/close", requireAdmin(closeRoomHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/rooms/{id}/abort-round", requireAdmin(abortRoundHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/admin/announce", requireAdmin(announceHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/debug/state", requireAdmin(debugStateHandler)).Methods(http.MethodGet)
+	return cors(r)
 }
 
 func serveWs(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if n := openConnections.Add(1); *maxConnections > 0 && n > *maxConnections {
+		openConnections.Add(-1)
+		slog.Warn("Connection limit reached", "event", "connection_rejected", "limit", *maxConnections)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Upgrade error:", err)
+		openConnections.Add(-1)
+		slog.Warn("Upgrade error", "error", err)
 		return
 	}
+	// Writes are only compressed if the client negotiated it
+	conn.EnableWriteCompression(*compression)
+	if *compression {
+		conn.SetCompressionLevel(*compressionLevel)
+	}
 
 	client := &Client{
-		id:         uuid.New().String(),
-		conn:       conn,
-		shootState: None,
-		roomID:     "",
+		id:          uuid.New().String(),
+		conn:        conn,
+		shootState:  None,
+		roomID:      "",
+		spectating:  make(map[string]bool),
+		send:        make(chan []byte, *sendBuffer),
+		limiter:     newTokenBucket(*messageRate, *messageBurst),
+		chatLimiter: newTokenBucket(*chatRate, *chatBurst),
+		done:        make(chan struct{}),
 	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
 
+	resumed := false
+	if token := r.URL.Query().Get("session"); token != "" {
+		resumed = hub.resumeSession(token, client)
+	}
+	if !resumed {
+		client.session = newSessionToken()
+		hub.startSession(client)
+	}
+
+	hub.register(client)
+	// Until the read pump starts, c.roomID is this goroutine's to read
+	if resumed {
+		client.logger().Info("Client reconnected", "event", "session_resumed")
+		client.sendResumed()
+	}
+	go client.writePump()
 	go client.readPump()
 }
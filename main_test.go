@@ -0,0 +1,1305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// frameTimeout is how long a test waits for a frame it expects.
+const frameTimeout = 2 * time.Second
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Rounds accept shots straight away so tests don't sit through the
+	// countdown
+	*countdownFrom = 0
+	// A message type whose handler always fails, to test panic recovery.
+	// It's added before any connection can read the table.
+	messageHandlers["testPanic"] = func(*Client, []byte) { panic("test panic") }
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer serves the full router in-process. Rooms live in the global
+// hub, so tests keep out of each other's way by naming rooms after
+// themselves. With -count the same test runs again as soon as it returns,
+// so the last run's room has to empty out first.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	eventually(t, "room from the last run removed", func() bool { return hub.lookupRoom(t.Name()) == nil })
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testClient drives the server over a real websocket. Frames are read in
+// the background, so a test can wait for one with a timeout without
+// breaking the connection.
+type testClient struct {
+	t      *testing.T
+	conn   *websocket.Conn
+	frames chan []byte
+	// closeErr is set before frames is closed
+	closeErr error
+	// done is closed when readLoop returns; reading is set once it starts
+	done    chan struct{}
+	reading bool
+
+	id      string
+	session string
+	// extensions is what the handshake negotiated
+	extensions string
+}
+
+func dialTest(t *testing.T, srv *httptest.Server, query string) *testClient {
+	t.Helper()
+	tc := dialPaused(t, srv, websocket.DefaultDialer, query)
+	tc.startReading()
+	return tc
+}
+
+// dialPaused connects without reading, so the server's writes back up
+// until the test starts readLoop.
+func dialPaused(t *testing.T, srv *httptest.Server, dialer *websocket.Dialer, query string) *testClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+	if query != "" {
+		url += "?" + query
+	}
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	tc := &testClient{t: t, conn: conn, frames: make(chan []byte, 1024), done: make(chan struct{}), extensions: resp.Header.Get("Sec-Websocket-Extensions")}
+	// The server may be gone by the time its close frame is echoed; the
+	// code it sent is what matters
+	conn.SetCloseHandler(func(code int, text string) error {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(time.Second))
+		return nil
+	})
+	t.Cleanup(tc.close)
+	return tc
+}
+
+func (tc *testClient) startReading() {
+	tc.reading = true
+	go tc.readLoop()
+}
+
+func (tc *testClient) readLoop() {
+	defer close(tc.done)
+	defer close(tc.frames)
+	for {
+		_, data, err := tc.conn.ReadMessage()
+		if err != nil {
+			tc.closeErr = err
+			return
+		}
+		tc.frames <- data
+	}
+}
+
+// close hangs up normally, so the server doesn't hold the seat for a
+// reconnect. It waits for the server to answer the close frame: closing
+// the socket first can reset the connection before the frame is read,
+// which the server takes for a drop.
+func (tc *testClient) close() {
+	tc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	if tc.reading {
+		select {
+		case <-tc.done:
+		case <-time.After(time.Second):
+		}
+	}
+	tc.conn.Close()
+}
+
+// drop cuts the connection without a close frame, the way a lost network
+// would.
+func (tc *testClient) drop() {
+	tc.conn.UnderlyingConn().Close()
+}
+
+func (tc *testClient) send(msg string) {
+	tc.t.Helper()
+	if err := tc.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		tc.t.Fatalf("send %s: %v", msg, err)
+	}
+}
+
+func (tc *testClient) sendf(format string, args ...interface{}) {
+	tc.t.Helper()
+	tc.send(fmt.Sprintf(format, args...))
+}
+
+// nextFrame returns the next raw frame, failing the test if none arrives in
+// time or the connection closes.
+func (tc *testClient) nextFrame() []byte {
+	tc.t.Helper()
+	select {
+	case data, ok := <-tc.frames:
+		if !ok {
+			tc.t.Fatalf("connection closed while waiting for a frame: %v", tc.closeErr)
+		}
+		return data
+	case <-time.After(frameTimeout):
+		tc.t.Fatalf("no frame within %v", frameTimeout)
+	}
+	return nil
+}
+
+// next returns the next frame decoded as a JSON object.
+func (tc *testClient) next() fields {
+	tc.t.Helper()
+	data := tc.nextFrame()
+	var msg fields
+	if err := json.Unmarshal(data, &msg); err != nil {
+		tc.t.Fatalf("frame %q is not a JSON object: %v", data, err)
+	}
+	return msg
+}
+
+// expectNext fails unless the very next frame matches want.
+func (tc *testClient) expectNext(want fields) fields {
+	tc.t.Helper()
+	msg := tc.next()
+	if !msg.matches(want) {
+		tc.t.Fatalf("got %v, want a frame matching %v", msg, want)
+	}
+	return msg
+}
+
+// waitFor skips frames until one matches want.
+func (tc *testClient) waitFor(want fields) fields {
+	tc.t.Helper()
+	deadline := time.After(frameTimeout)
+	var skipped []string
+	for {
+		select {
+		case data, ok := <-tc.frames:
+			if !ok {
+				tc.t.Fatalf("connection closed waiting for %v (%v); skipped %v", want, tc.closeErr, skipped)
+			}
+			var msg fields
+			if json.Unmarshal(data, &msg) == nil && msg.matches(want) {
+				return msg
+			}
+			// Keep the last few for the failure message
+			if skipped = append(skipped, string(data)); len(skipped) > 5 {
+				skipped = skipped[1:]
+			}
+		case <-deadline:
+			tc.t.Fatalf("no frame matching %v within %v; skipped %v", want, frameTimeout, skipped)
+			return nil
+		}
+	}
+}
+
+// framesUntil returns every frame up to and including the first that
+// matches want.
+func (tc *testClient) framesUntil(want fields) [][]byte {
+	tc.t.Helper()
+	deadline := time.After(frameTimeout)
+	var frames [][]byte
+	for {
+		select {
+		case data, ok := <-tc.frames:
+			if !ok {
+				tc.t.Fatalf("connection closed waiting for %v (%v)", want, tc.closeErr)
+			}
+			frames = append(frames, data)
+			var msg fields
+			if json.Unmarshal(data, &msg) == nil && msg.matches(want) {
+				return frames
+			}
+		case <-deadline:
+			tc.t.Fatalf("no frame matching %v within %v", want, frameTimeout)
+			return nil
+		}
+	}
+}
+
+// expectNone fails if a frame matching want arrives within d. Other frames
+// are consumed.
+func (tc *testClient) expectNone(want fields, d time.Duration) {
+	tc.t.Helper()
+	deadline := time.After(d)
+	for {
+		select {
+		case data, ok := <-tc.frames:
+			if !ok {
+				return
+			}
+			var msg fields
+			if json.Unmarshal(data, &msg) == nil && msg.matches(want) {
+				tc.t.Fatalf("unexpected frame %s", data)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// drain throws away whatever has arrived so far.
+func (tc *testClient) drain() {
+	for {
+		select {
+		case _, ok := <-tc.frames:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// expectClosed waits for the server to close the connection and returns
+// the close code it sent, or -1 if it hung up without one.
+func (tc *testClient) expectClosed() int {
+	tc.t.Helper()
+	deadline := time.After(frameTimeout)
+	for {
+		select {
+		case _, ok := <-tc.frames:
+			if ok {
+				continue
+			}
+			if closeErr, isClose := tc.closeErr.(*websocket.CloseError); isClose {
+				return closeErr.Code
+			}
+			tc.t.Logf("closed without a close frame: %v", tc.closeErr)
+			return -1
+		case <-deadline:
+			tc.t.Fatalf("connection still open after %v", frameTimeout)
+			return 0
+		}
+	}
+}
+
+// join joins the room and waits for the confirmation, remembering the
+// client's id and session.
+func (tc *testClient) join(roomID string) fields {
+	tc.t.Helper()
+	return tc.joinWith(fmt.Sprintf(`{"join":%q}`, roomID))
+}
+
+func (tc *testClient) joinWith(msg string) fields {
+	tc.t.Helper()
+	tc.send(msg)
+	joined := tc.waitFor(fields{"joined": anyValue})
+	tc.id = joined["joined"].(string)
+	tc.session = joined["session"].(string)
+	return joined
+}
+
+// shoot throws the choice and waits for it to be accepted.
+func (tc *testClient) shoot(choice string) {
+	tc.t.Helper()
+	tc.sendf(`{"shoot":%q}`, choice)
+	tc.waitFor(fields{"shot": "accepted"})
+}
+
+// joinPlayers connects n players to the room, with everyone having heard
+// about everyone else.
+func joinPlayers(t *testing.T, srv *httptest.Server, roomID string, n int) []*testClient {
+	t.Helper()
+	players := make([]*testClient, n)
+	for i := range players {
+		players[i] = dialTest(t, srv, "")
+		players[i].join(roomID)
+		players[i].waitFor(fields{"players": withLength(i + 1)})
+	}
+	for i, player := range players {
+		for _, later := range players[i+1:] {
+			player.waitFor(fields{"new": later.id})
+		}
+		player.drain()
+	}
+	return players
+}
+
+// startGame readies every player and waits until the first round accepts
+// shots.
+func startGame(t *testing.T, players ...*testClient) {
+	t.Helper()
+	for _, player := range players {
+		player.send(`{"fight":true}`)
+	}
+	for _, player := range players {
+		player.waitFor(fields{"fight": "start"})
+		player.waitFor(fields{"shoot": "go"})
+	}
+}
+
+// byID orders clients to match the server's id-sorted results.
+func byID(clients ...*testClient) []string {
+	ids := make([]string, len(clients))
+	for i, client := range clients {
+		ids[i] = client.id
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// fields is a decoded JSON frame, or the fields a frame is expected to
+// have.
+type fields map[string]interface{}
+
+// anyValue matches a field that is present, whatever its value.
+var anyValue = &struct{}{}
+
+// lengthOf matches an array field with the given number of elements.
+type lengthOf int
+
+func withLength(n int) lengthOf { return lengthOf(n) }
+
+// matches reports whether msg has every field in want. Expected values are
+// compared in their JSON form, so a []string matches a decoded array and a
+// ShootState matches its number.
+func (msg fields) matches(want fields) bool {
+	for key, wantValue := range want {
+		got, present := msg[key]
+		if !present {
+			return false
+		}
+		switch wantValue := wantValue.(type) {
+		case *struct{}:
+			continue
+		case lengthOf:
+			list, isList := got.([]interface{})
+			if !isList || len(list) != int(wantValue) {
+				return false
+			}
+			continue
+		}
+		var normalized interface{}
+		if err := json.Unmarshal(marshal(wantValue), &normalized); err != nil || !reflect.DeepEqual(got, normalized) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestJoinFightShootResult plays a heads-up game from join to the final
+// result.
+func TestJoinFightShootResult(t *testing.T) {
+	srv := newTestServer(t)
+	roomID := t.Name()
+
+	alice := dialTest(t, srv, "")
+	joined := alice.join(roomID)
+	if !joined.matches(fields{"room": roomID, "role": "player", "owner": alice.id, "state": "waiting"}) {
+		t.Fatalf("joined = %v", joined)
+	}
+	alice.expectNext(fields{"players": withLength(1)})
+
+	bob := dialTest(t, srv, "")
+	bob.join(roomID)
+	alice.expectNext(fields{"new": bob.id, "role": "player"})
+
+	alice.send(`{"fight":true}`)
+	bob.waitFor(fields{"fight": "waiting", "ready": []string{alice.id}, "notReady": []string{bob.id}})
+	bob.send(`{"fight":true}`)
+	for _, player := range []*testClient{alice, bob} {
+		player.waitFor(fields{"fight": "start", "activePlayers": byID(alice, bob)})
+		player.waitFor(fields{"shoot": "go"})
+	}
+
+	alice.shoot("rock")
+	alice.expectNext(fields{"shot": "waiting_for_others"})
+	bob.shoot("scissors")
+
+	for _, player := range []*testClient{alice, bob} {
+		player.waitFor(fields{
+			"result":  "final_win",
+			"winner":  alice.id,
+			"choices": map[string]ShootState{alice.id: Rock, bob.id: Scissors},
+		})
+		player.expectNext(fields{"scoreboard": map[string]int{alice.id: 1}})
+	}
+}
+
+// TestDrawReplaysRound checks that a drawn round is played again with
+// everyone still in.
+func TestDrawReplaysRound(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+
+	alice.shoot("paper")
+	bob.shoot("paper")
+	for _, player := range players {
+		player.waitFor(fields{"result": "draw", "reason": drawSame})
+		player.waitFor(fields{"shoot": "go"})
+	}
+
+	alice.shoot("paper")
+	bob.shoot("scissors")
+	alice.waitFor(fields{"result": "final_win", "winner": bob.id})
+}
+
+// TestShootBeforeJoin checks the errors a client gets for playing outside a
+// room.
+func TestShootBeforeJoin(t *testing.T) {
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+	client.send(`{"shoot":"rock","id":7}`)
+	client.expectNext(fields{"error": "not_in_room", "id": 7})
+}
+
+// TestConcurrentFights has players send fight and shoot while rounds time
+// out and games end under them. Run it with -race: the handlers used to
+// read the room's roster without its lock.
+func TestConcurrentFights(t *testing.T) {
+	defer setFlag(roundTimeout, 50*time.Millisecond)()
+	defer setFlag(messageRate, 0)()
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	shooter, idle := players[0], players[1:]
+
+	for game := 0; game < 5; game++ {
+		var wg sync.WaitGroup
+		for _, player := range players {
+			wg.Add(1)
+			go func(conn *websocket.Conn) {
+				defer wg.Done()
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"fight":true}`))
+			}(player.conn)
+		}
+		wg.Wait()
+		for _, player := range players {
+			player.waitFor(fields{"shoot": "go"})
+		}
+
+		// The shooter wins once the others time out, while everyone keeps
+		// sending messages that look at the roster
+		spam := func(conn *websocket.Conn, msg string) {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				conn.WriteMessage(websocket.TextMessage, []byte(msg))
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		wg.Add(len(players))
+		go spam(shooter.conn, `{"shoot":"rock"}`)
+		for _, player := range idle {
+			go spam(player.conn, `{"fight":true}`)
+		}
+		wg.Wait()
+		for _, player := range players {
+			player.waitFor(fields{"result": "final_win", "winner": shooter.id})
+			player.drain()
+		}
+	}
+}
+
+// eventually polls cond until it holds, failing the test if it doesn't
+// within frameTimeout.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(frameTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// setFlag changes a flag for the length of a test and returns a func that
+// puts it back.
+func setFlag[T any](flag *T, value T) func() {
+	old := *flag
+	*flag = value
+	return func() { *flag = old }
+}
+
+// TestScoreboardAcrossGames checks that game wins add up over a session.
+func TestScoreboardAcrossGames(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+
+	for game := 1; game <= 2; game++ {
+		startGame(t, alice, bob)
+		alice.shoot("scissors")
+		bob.shoot("paper")
+		for _, player := range players {
+			player.waitFor(fields{"result": "final_win", "winner": alice.id})
+			player.expectNext(fields{"scoreboard": map[string]int{alice.id: game}})
+		}
+	}
+}
+
+// TestSpectator checks that a spectator sees the game but can't play in it.
+func TestSpectator(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	watcher := dialTest(t, srv, "")
+	watcher.joinWith(fmt.Sprintf(`{"join":%q,"role":"spectator"}`, t.Name()))
+
+	watcher.send(`{"fight":true}`)
+	watcher.waitFor(fields{"error": "spectators_cannot_play"})
+	startGame(t, alice, bob)
+	watcher.send(`{"shoot":"rock"}`)
+	watcher.waitFor(fields{"error": "spectators_cannot_play"})
+
+	alice.shoot("rock")
+	bob.shoot("paper")
+	watcher.waitFor(fields{"result": "final_win", "winner": bob.id})
+}
+
+// TestRejoinAsSpectatorKeepsSeat checks that a player asking to join their
+// own room again, as a spectator under another name, stays the player they
+// were.
+func TestRejoinAsSpectatorKeepsSeat(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+
+	alice.sendf(`{"join":%q,"role":"spectator","name":"Eve"}`, t.Name())
+	startGame(t, alice, bob)
+	alice.shoot("rock")
+	bob.shoot("scissors")
+	bob.waitFor(fields{"result": "final_win", "winner": alice.id, "name": alice.id[:8]})
+}
+
+// TestDisconnectMidRound checks that a round doesn't wait on a player who
+// dropped without shooting.
+func TestDisconnectMidRound(t *testing.T) {
+	defer setFlag(reconnectGrace, 0)()
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	alice, bob, carol := players[0], players[1], players[2]
+	startGame(t, players...)
+
+	alice.shoot("rock")
+	bob.shoot("scissors")
+	carol.drop()
+
+	for _, player := range []*testClient{alice, bob} {
+		player.waitFor(fields{"left": carol.id})
+		player.waitFor(fields{"result": "final_win", "winner": alice.id})
+	}
+}
+
+// TestEliminationResultsHaveNoEmptyFrames plays a four-player game over
+// three rounds, so a player knocked out early is still in the room when
+// later rounds knock others out.
+func TestEliminationResultsHaveNoEmptyFrames(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 4)
+	a, b, c, d := players[0], players[1], players[2], players[3]
+	startGame(t, players...)
+
+	// Every frame a player gets must be a whole JSON object
+	expect := func(player *testClient, want fields) {
+		t.Helper()
+		for _, frame := range player.framesUntil(want) {
+			var msg fields
+			if err := json.Unmarshal(frame, &msg); err != nil || len(msg) == 0 {
+				t.Fatalf("player got frame %q", frame)
+			}
+		}
+	}
+
+	a.shoot("rock")
+	b.shoot("rock")
+	c.shoot("rock")
+	d.shoot("scissors")
+	expect(d, fields{"result": "lose", "beatenBy": byID(a, b, c)})
+	for _, player := range players {
+		expect(player, fields{"remaining": 3, "activePlayers": byID(a, b, c)})
+		expect(player, fields{"shoot": "go"})
+	}
+
+	a.shoot("paper")
+	b.shoot("paper")
+	c.shoot("rock")
+	expect(a, fields{"result": "win"})
+	expect(c, fields{"result": "lose", "round": 2})
+	expect(d, fields{"result": "spectating"})
+	for _, player := range players {
+		expect(player, fields{"remaining": 2})
+		expect(player, fields{"shoot": "go"})
+	}
+
+	a.shoot("scissors")
+	b.shoot("paper")
+	for _, player := range players {
+		expect(player, fields{"result": "final_win", "winner": a.id})
+	}
+}
+
+// TestNotReadyShrinks readies a room up one player at a time.
+func TestNotReadyShrinks(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 4)
+	last := players[3]
+	for i, player := range players[:3] {
+		player.send(`{"fight":true}`)
+		last.waitFor(fields{"fight": "waiting", "ready": byID(players[:i+1]...), "notReady": byID(players[i+1:]...)})
+	}
+	last.send(`{"fight":true}`)
+	for _, player := range players {
+		player.waitFor(fields{"fight": "start", "activePlayers": byID(players...)})
+	}
+}
+
+// TestSecondRoundAfterElimination checks that the round after an
+// elimination is played by the survivors alone.
+func TestSecondRoundAfterElimination(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	alice, bob, carol := players[0], players[1], players[2]
+	startGame(t, players...)
+
+	alice.shoot("rock")
+	bob.shoot("rock")
+	carol.shoot("scissors")
+	for _, player := range players {
+		player.waitFor(fields{"remaining": 2, "activePlayers": byID(alice, bob)})
+		player.expectNext(fields{"shoot": "go"})
+	}
+
+	carol.send(`{"shoot":"paper"}`)
+	carol.expectNext(fields{"error": "not_active_player"})
+	alice.shoot("paper")
+	bob.shoot("rock")
+	for _, player := range players {
+		player.waitFor(fields{"result": "final_win", "winner": alice.id})
+	}
+}
+
+func TestBeatsTruthTable(t *testing.T) {
+	order := []ShootState{Rock, Paper, Scissors, Lizard, Spock}
+	// want[i][j] is whether order[i] beats order[j]
+	want := [5][5]bool{
+		// rock, paper, scissors, lizard, spock
+		{false, false, true, true, false}, // rock
+		{true, false, false, false, true}, // paper
+		{false, true, false, true, false}, // scissors
+		{false, true, false, false, true}, // lizard
+		{true, false, true, false, false}, // spock
+	}
+	for i, a := range order {
+		for j, b := range order {
+			if got := beats(a, b); got != want[i][j] {
+				t.Errorf("beats(%d, %d) = %v, want %v", a, b, got, want[i][j])
+			}
+		}
+		if beats(a, None) || beats(None, a) {
+			t.Errorf("None beats or is beaten by %d", a)
+		}
+	}
+}
+
+func TestSurvivingChoices(t *testing.T) {
+	tests := []struct {
+		thrown            []ShootState
+		surviving, beaten []ShootState
+	}{
+		{nil, nil, nil},
+		{[]ShootState{Rock}, []ShootState{Rock}, nil},
+		{[]ShootState{Rock, Scissors}, []ShootState{Rock}, []ShootState{Scissors}},
+		{[]ShootState{Paper, Rock, Scissors}, nil, []ShootState{Paper, Rock, Scissors}},
+		{[]ShootState{Rock, Lizard, Scissors}, []ShootState{Rock}, []ShootState{Lizard, Scissors}},
+		{[]ShootState{Spock, Paper, Rock}, []ShootState{Paper}, []ShootState{Spock, Rock}},
+	}
+	for _, tt := range tests {
+		surviving, beaten := survivingChoices(tt.thrown)
+		if !reflect.DeepEqual(surviving, tt.surviving) || !reflect.DeepEqual(beaten, tt.beaten) {
+			t.Errorf("survivingChoices(%v) = %v, %v; want %v, %v", tt.thrown, surviving, beaten, tt.surviving, tt.beaten)
+		}
+	}
+}
+
+// TestLeaveMidGameClearsReady checks that a player who left during a game
+// leaves nothing behind in the next game's ready tracking.
+func TestLeaveMidGameClearsReady(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	alice, bob, carol := players[0], players[1], players[2]
+	startGame(t, players...)
+
+	carol.send(`{"leave":true}`)
+	alice.waitFor(fields{"left": carol.id})
+	alice.shoot("rock")
+	bob.shoot("scissors")
+	bob.waitFor(fields{"result": "final_win", "winner": alice.id})
+
+	room := hub.lookupRoom(t.Name())
+	room.lock.RLock()
+	ready := fmt.Sprint(room.ready)
+	room.lock.RUnlock()
+	if want := fmt.Sprint(map[string]bool{}); ready != want {
+		t.Fatalf("ready after the game = %s, want %s", ready, want)
+	}
+
+	alice.send(`{"fight":true}`)
+	bob.waitFor(fields{"fight": "waiting", "ready": []string{alice.id}, "notReady": []string{bob.id}})
+	bob.send(`{"fight":true}`)
+	alice.waitFor(fields{"fight": "start", "activePlayers": byID(alice, bob)})
+}
+
+// TestOversizedMessageClosesConnection sends a frame over
+// -max-message-size.
+func TestOversizedMessageClosesConnection(t *testing.T) {
+	defer setFlag(maxMessageSize, 1024)()
+	defer setFlag(reconnectGrace, time.Duration(0))()
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+	client.join(t.Name())
+
+	client.sendf(`{"chat":%q}`, strings.Repeat("x", 2048))
+	if code := client.expectClosed(); code != websocket.CloseMessageTooBig {
+		t.Fatalf("close code = %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+	eventually(t, "client unregistered", func() bool {
+		hub.lock.RLock()
+		defer hub.lock.RUnlock()
+		return hub.clients[client.id] == nil
+	})
+	eventually(t, "room removed", func() bool { return hub.lookupRoom(t.Name()) == nil })
+}
+
+// TestLargestMessageAllowed sends a frame just under -max-message-size.
+func TestLargestMessageAllowed(t *testing.T) {
+	defer setFlag(maxMessageSize, 1024)()
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+	client.join(t.Name())
+
+	client.sendf(`{"chat":"hi","pad":%q}`, strings.Repeat("x", 1000))
+	client.waitFor(fields{"chat": fields{"from": client.id, "name": client.id[:8], "text": "hi"}})
+}
+
+// TestOpponentDropsAfterStart checks that a heads-up game whose other
+// player drops as it starts ends with a winner rather than rounds of the
+// last player drawing with themselves.
+func TestOpponentDropsAfterStart(t *testing.T) {
+	defer setFlag(reconnectGrace, 0)()
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+
+	bob.drop()
+	alice.waitFor(fields{"left": bob.id})
+	alice.expectNext(fields{"result": "final_win", "winner": alice.id})
+	alice.expectNext(fields{"scoreboard": map[string]int{alice.id: 1}})
+	alice.expectNone(fields{"shoot": "go"}, 100*time.Millisecond)
+}
+
+// TestLonePlayerWinsAtRoundStart checks the case of everyone else leaving
+// between rounds.
+func TestLonePlayerWinsAtRoundStart(t *testing.T) {
+	room := newRoom(t.Name(), roomOptions{mode: ClassicMode})
+	alice, bob := newTestMember("alice"), newTestMember("bob")
+	room.addClient(alice, seat{name: "Alice"})
+	room.addClient(bob, seat{name: "Bob"})
+	room.setReady(alice.id, true)
+	room.setReady(bob.id, true)
+	if started, err := room.tryStart(false); !started || err != nil {
+		t.Fatalf("tryStart = %v, %v", started, err)
+	}
+	room.removeClient(bob)
+
+	room.startRound()
+	queued := queuedMessages(alice)
+	if !containsFrame(queued, fields{"result": "final_win", "winner": alice.id}) {
+		t.Fatalf("got %v, want a final win", queued)
+	}
+	if containsFrame(queued, fields{"shoot": "go"}) {
+		t.Fatalf("a round was opened with one player: %v", queued)
+	}
+	if state, _ := room.gameState(); state != Waiting {
+		t.Fatalf("state = %v, want waiting", state)
+	}
+}
+
+// TestLateCloseLeavesNextRoundOpen has a round settled by its timer and the
+// next one opened between a shot and the shooter closing the round. The
+// shooter's close must not end the new round.
+func TestLateCloseLeavesNextRoundOpen(t *testing.T) {
+	room := newRoom(t.Name(), roomOptions{mode: ClassicMode})
+	alice, bob := newTestMember("alice"), newTestMember("bob")
+	room.addClient(alice, seat{name: "Alice"})
+	room.addClient(bob, seat{name: "Bob"})
+	room.setReady(alice.id, true)
+	room.setReady(bob.id, true)
+	if started, err := room.tryStart(false); !started || err != nil {
+		t.Fatalf("tryStart = %v, %v", started, err)
+	}
+	room.startRound()
+	round, err := room.recordShot(alice.id, Rock)
+	if err != nil {
+		t.Fatalf("recordShot: %v", err)
+	}
+
+	// What the round timer does
+	if !room.closeRound(round) {
+		t.Fatal("round already closed")
+	}
+	room.startRound()
+
+	if room.closeRound(round) {
+		t.Fatal("closing the old round closed the new one")
+	}
+	room.lock.RLock()
+	defer room.lock.RUnlock()
+	if !room.roundOpen || room.round != round+1 {
+		t.Fatalf("round %d open = %v, want round %d open", room.round, room.roundOpen, round+1)
+	}
+}
+
+// newTestMember makes a client with no connection whose messages stay in
+// its send queue.
+func newTestMember(id string) *Client {
+	return &Client{id: id, send: make(chan []byte, 256)}
+}
+
+func queuedMessages(c *Client) []fields {
+	var queued []fields
+	for {
+		select {
+		case data := <-c.send:
+			var msg fields
+			json.Unmarshal(data, &msg)
+			queued = append(queued, msg)
+		default:
+			return queued
+		}
+	}
+}
+
+func containsFrame(frames []fields, want fields) bool {
+	for _, msg := range frames {
+		if msg.matches(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestJoinAnotherRoomLeavesTheFirst checks that a client is only ever in
+// one room.
+func TestJoinAnotherRoomLeavesTheFirst(t *testing.T) {
+	srv := newTestServer(t)
+	roomA, roomB := t.Name()+"-a", t.Name()+"-b"
+	players := joinPlayers(t, srv, roomA, 2)
+	alice, bob := players[0], players[1]
+
+	alice.join(roomB)
+	bob.waitFor(fields{"left": alice.id})
+	if hub.lookupRoom(roomA).hasClient(&Client{id: alice.id}) {
+		t.Fatal("client still in the first room")
+	}
+	if !hub.lookupRoom(roomB).hasClient(&Client{id: alice.id}) {
+		t.Fatal("client not in the second room")
+	}
+
+	// Joining the same room again changes nothing
+	alice.sendf(`{"join":%q,"id":"again"}`, roomB)
+	alice.waitFor(fields{"error": "already_in_room", "id": "again"})
+}
+
+// TestRefusedJoinKeepsRoom checks that a player whose join is refused is
+// still in the room it was in.
+func TestRefusedJoinKeepsRoom(t *testing.T) {
+	srv := newTestServer(t)
+	roomA, full, private := t.Name()+"-a", t.Name()+"-full", t.Name()+"-private"
+	players := joinPlayers(t, srv, roomA, 2)
+	alice, bob := players[0], players[1]
+
+	restore := setFlag(maxPlayers, 1)
+	dialTest(t, srv, "").join(full)
+	restore()
+	alice.sendf(`{"join":%q}`, full)
+	alice.expectNext(fields{"error": "room_full"})
+
+	resp, err := http.Post(srv.URL+"/rooms", "application/json", strings.NewReader(`{"id":"`+private+`","password":"secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	defer hub.deleteRoomIfEmpty(private)
+	alice.sendf(`{"join":%q,"password":"guess"}`, private)
+	alice.expectNext(fields{"error": "bad_password"})
+
+	bob.expectNone(fields{"left": alice.id}, 50*time.Millisecond)
+	alice.send(`{"chat":"still here"}`)
+	bob.expectNext(fields{"chat": fields{"from": alice.id, "name": alice.id[:8], "text": "still here"}})
+}
+
+// TestJoinLastRoomDeletesIt checks that moving out of a room nobody else is
+// in closes it.
+func TestJoinLastRoomDeletesIt(t *testing.T) {
+	srv := newTestServer(t)
+	roomA, roomB := t.Name()+"-a", t.Name()+"-b"
+	client := dialTest(t, srv, "")
+	client.join(roomA)
+	client.join(roomB)
+	if hub.lookupRoom(roomA) != nil {
+		t.Fatal("empty room left open")
+	}
+}
+
+// TestFightAloneAfterOthersLeave checks that a room emptied down to one
+// player refuses to start rather than begin a game nobody can play.
+func TestFightAloneAfterOthersLeave(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+
+	alice.send(`{"fight":true}`)
+	bob.waitFor(fields{"fight": "waiting"})
+	bob.close()
+	alice.waitFor(fields{"left": bob.id})
+
+	alice.send(`{"fight":true}`)
+	alice.expectNext(fields{"error": "cannot_start"})
+	alice.send(`{"fight":"force"}`)
+	alice.expectNext(fields{"error": "cannot_start"})
+	if state, _ := hub.lookupRoom(t.Name()).gameState(); state != Waiting {
+		t.Fatalf("state = %v, want waiting", state)
+	}
+}
+
+// TestForceStartWithNobodyElseReady checks the owner can't force a game
+// with only themselves ready.
+func TestForceStartWithNobodyElseReady(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	players[0].send(`{"fight":"force"}`)
+	players[0].expectNext(fields{"error": "cannot_start"})
+}
+
+func TestFightBelowMinPlayers(t *testing.T) {
+	defer setFlag(minPlayers, 3)()
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	players[0].send(`{"fight":true}`)
+	players[1].waitFor(fields{"fight": "waiting"})
+	players[1].send(`{"fight":true}`)
+	players[1].expectNext(fields{"error": "not_enough_players", "detail": "at least 3 players are needed"})
+}
+
+// TestJoinTimeout checks that a socket which never joins is closed.
+func TestJoinTimeout(t *testing.T) {
+	defer setFlag(joinTimeout, 100*time.Millisecond)()
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+
+	// Messages other than a join don't count
+	client.send(`{"chat":"hello?"}`)
+	client.expectNext(fields{"error": "not_in_room"})
+	client.expectNext(fields{"error": "join_timeout"})
+	if code := client.expectClosed(); code != closeJoinTimeout {
+		t.Fatalf("close code = %d, want %d", code, closeJoinTimeout)
+	}
+}
+
+// TestJoinClearsJoinTimeout checks that a client that joined in time isn't
+// held to the join deadline afterwards.
+func TestJoinClearsJoinTimeout(t *testing.T) {
+	defer setFlag(joinTimeout, 100*time.Millisecond)()
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+	client.join(t.Name())
+
+	client.expectNone(fields{"error": "join_timeout"}, 300*time.Millisecond)
+	client.send(`{"chat":"still here"}`)
+	client.waitFor(fields{"chat": fields{"from": client.id, "name": client.id[:8], "text": "still here"}})
+}
+
+// TestDoubleLeave sends leave twice and then drops the socket, checking the
+// departure is announced once.
+func TestDoubleLeave(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+
+	alice.send(`{"leave":true}`)
+	alice.send(`{"leave":true}`)
+	alice.close()
+	bob.expectNext(fields{"left": alice.id})
+	bob.expectNone(fields{"left": alice.id}, 100*time.Millisecond)
+
+	// The last player out closes the room, once
+	bob.send(`{"leave":true}`)
+	eventually(t, "room closed", func() bool { return hub.lookupRoom(t.Name()) == nil })
+	bob.send(`{"leave":true}`)
+	bob.send(`{"chat":"anyone?"}`)
+	bob.expectNext(fields{"error": "not_in_room"})
+}
+
+// TestLeaveRemovedRoom leaves a room that has already gone, and removes a
+// client twice from a room directly.
+func TestLeaveRemovedRoom(t *testing.T) {
+	ghost := newTestMember("ghost")
+	ghost.roomID = t.Name()
+	ghost.leaveRoom()
+	if ghost.roomID != "" {
+		t.Fatalf("roomID = %q after leaving a room that doesn't exist", ghost.roomID)
+	}
+
+	room := newRoom(t.Name(), roomOptions{mode: ClassicMode})
+	alice, bob := newTestMember("alice"), newTestMember("bob")
+	room.addClient(alice, seat{name: "Alice"})
+	room.addClient(bob, seat{name: "Bob"})
+	if !room.removeClient(alice) {
+		t.Fatal("first removeClient = false")
+	}
+	if room.removeClient(alice) {
+		t.Fatal("second removeClient = true")
+	}
+	left := 0
+	for _, msg := range queuedMessages(bob) {
+		if msg.matches(fields{"left": alice.id}) {
+			left++
+		}
+	}
+	if left != 1 {
+		t.Fatalf("left announced %d times, want once", left)
+	}
+}
+
+// TestHandlerPanicKeepsConnection checks that a message whose handler
+// panics costs the client that message, not its connection.
+func TestHandlerPanicKeepsConnection(t *testing.T) {
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+	client.join(t.Name())
+	client.waitFor(fields{"players": anyValue})
+
+	client.send(`{"testPanic":true,"id":1}`)
+	client.expectNext(fields{"error": "internal", "id": 1})
+	client.send(`{"chat":"still here"}`)
+	client.expectNext(fields{"chat": fields{"from": client.id, "name": client.id[:8], "text": "still here"}})
+}
+
+// TestBroadcastDuringChurn has clients join and leave a room over and over
+// while others chat in it. Run it with -race.
+func TestBroadcastDuringChurn(t *testing.T) {
+	defer setFlag(messageRate, 0)()
+	defer setFlag(chatRate, 0)()
+	// The stable players get every join, leave and chat, faster than a
+	// real client would
+	defer setFlag(sendBuffer, 4096)()
+	srv := newTestServer(t)
+	stable := joinPlayers(t, srv, t.Name(), 2)
+	churners := make([]*testClient, 8)
+	for i := range churners {
+		churners[i] = dialTest(t, srv, "")
+	}
+
+	var wg sync.WaitGroup
+	for _, churner := range churners {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"join":%q}`, t.Name())))
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"leave":true}`))
+			}
+		}(churner.conn)
+	}
+	for _, player := range stable {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"chat":"hi"}`))
+			}
+		}(player.conn)
+	}
+	wg.Wait()
+
+	room := hub.lookupRoom(t.Name())
+	eventually(t, "churners gone", func() bool { return len(room.members()) == 2 })
+	stable[0].send(`{"chat":"done"}`)
+	stable[1].waitFor(fields{"chat": fields{"from": stable[0].id, "name": stable[0].id[:8], "text": "done"}})
+	if got := room.detail().Clients; !reflect.DeepEqual(got, byID(stable...)) {
+		t.Fatalf("clients = %v, want %v", got, byID(stable...))
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	srv := newTestServer(t)
+	eventually(t, "earlier connections closed", func() bool { return openConnections.Load() == 0 })
+	defer setFlag(maxConnections, int64(3))()
+	clients := make([]*testClient, 3)
+	for i := range clients {
+		clients[i] = dialTest(t, srv, "")
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("dial past the limit: err = %v, want %v", err, websocket.ErrBadHandshake)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	// Closing one frees its slot
+	clients[0].close()
+	eventually(t, "slot freed", func() bool { return openConnections.Load() == 2 })
+	dialTest(t, srv, "").join(t.Name())
+}
+
+// stallReader joins a client that doesn't read and sends it more offers
+// than its socket and send buffer can hold. It returns the stalled client
+// and the number of offers sent.
+func stallReader(t *testing.T, srv *httptest.Server) (alice, stalled *testClient, sent int) {
+	t.Helper()
+	alice = dialTest(t, srv, "")
+	alice.join(t.Name())
+	// Only the stalled client gets a small buffer; alice hears about
+	// every offer that can't be delivered once it's gone
+	t.Cleanup(setFlag(sendBuffer, 4))
+	stalled = dialPaused(t, srv, websocket.DefaultDialer, "")
+	stalled.sendf(`{"join":%q}`, t.Name())
+	stalled.id = alice.waitFor(fields{"new": anyValue})["new"].(string)
+
+	// Well past what the loopback socket buffers take
+	sent = 150
+	sdp := strings.Repeat("a", 60000)
+	for i := 0; i < sent; i++ {
+		alice.sendf(`{"offer":{"type":"offer","sdp":%q},"to":%q}`, sdp, stalled.id)
+	}
+	// Alice's messages are handled in order, so once her chat comes back
+	// every offer has been queued or refused
+	alice.send(`{"chat":"flooded"}`)
+	alice.waitFor(fields{"chat": fields{"from": alice.id, "name": alice.id[:8], "text": "flooded"}})
+	return alice, stalled, sent
+}
+
+func TestStalledReaderDisconnected(t *testing.T) {
+	defer setFlag(messageRate, 0)()
+	defer setFlag(reconnectGrace, time.Duration(0))()
+	srv := newTestServer(t)
+	_, stalled, _ := stallReader(t, srv)
+
+	// What was queued before the buffer filled is still delivered, then
+	// the server hangs up
+	stalled.startReading()
+	if code := stalled.expectClosed(); code != closeSlowClient {
+		t.Fatalf("close code = %d, want %d", code, closeSlowClient)
+	}
+	// No seat is held for it, so the room empties once alice closes
+	room := hub.lookupRoom(t.Name())
+	eventually(t, "stalled client removed", func() bool { return len(room.members()) == 1 })
+}
+
+func TestStalledReaderDropsMessages(t *testing.T) {
+	defer setFlag(messageRate, 0)()
+	defer setFlag(slowClient, "drop")()
+	srv := newTestServer(t)
+	alice, stalled, sent := stallReader(t, srv)
+
+	hub.lock.RLock()
+	queue := hub.clients[stalled.id].send
+	hub.lock.RUnlock()
+	stalled.startReading()
+	// Until the queue has room the chat would be dropped too
+	eventually(t, "send queue drained", func() bool { return len(queue) == 0 })
+	alice.send(`{"chat":"caught up"}`)
+	offers := 0
+	for _, frame := range stalled.framesUntil(fields{"chat": fields{"from": alice.id, "name": alice.id[:8], "text": "caught up"}}) {
+		if bytes.Contains(frame, []byte(`"offer"`)) {
+			offers++
+		}
+	}
+	if offers == 0 || offers >= sent {
+		t.Fatalf("stalled client got %d of %d offers, want some dropped", offers, sent)
+	}
+}
+
+// TestReconnectWhileStillConnected resumes a session before the server has
+// noticed the old socket is gone. The old connection is closed and the new
+// one takes over the seat and the shot already made.
+func TestReconnectWhileStillConnected(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+	alice.shoot("rock")
+
+	again := dialTest(t, srv, "session="+alice.session)
+	if code := alice.expectClosed(); code != closeReplaced {
+		t.Fatalf("old connection close code = %d, want %d", code, closeReplaced)
+	}
+	again.expectNext(fields{"resumed": alice.id, "roomID": t.Name(), "session": alice.session})
+	again.expectNext(fields{"players": withLength(2)})
+	bob.expectNext(fields{"reconnected": alice.id})
+
+	bob.shoot("scissors")
+	again.waitFor(fields{"result": "final_win", "winner": alice.id})
+	bob.waitFor(fields{"result": "final_win", "winner": alice.id})
+}
+
+// TestCompressedSignalRelay relays an offer much bigger than a typical
+// frame over compressed connections. Apart from "from" it must arrive
+// byte for byte.
+func TestCompressedSignalRelay(t *testing.T) {
+	defer setFlag(compression, true)()
+	defer setFlag(&upgrader.EnableCompression, true)()
+	defer setFlag(messageRate, 0)()
+	srv := newTestServer(t)
+	dialer := &websocket.Dialer{EnableCompression: true}
+	alice := dialPaused(t, srv, dialer, "")
+	bob := dialPaused(t, srv, dialer, "")
+	for _, client := range []*testClient{alice, bob} {
+		if !strings.Contains(client.extensions, "permessage-deflate") {
+			t.Fatalf("extensions = %q, want permessage-deflate", client.extensions)
+		}
+		client.startReading()
+		client.join(t.Name())
+	}
+	alice.waitFor(fields{"new": bob.id})
+
+	var sdp strings.Builder
+	sdp.WriteString("v=0\\r\\no=- 4611731400430051336 2 IN IP4 127.0.0.1\\r\\ns=-\\r\\n")
+	for i := 0; sdp.Len() < 40000; i++ {
+		fmt.Fprintf(&sdp, "a=candidate:%d 1 udp %d 192.168.%d.%d %d typ host generation 0\\r\\n", i, 2122260223-i, i%256, i*7%256, 50000+i)
+	}
+	offer := fmt.Sprintf(`{"type":"offer","sdp":"%s"}`, sdp.String())
+	alice.sendf(`{"offer":%s,"to":%q}`, offer, bob.id)
+
+	var relayed map[string]json.RawMessage
+	for {
+		frame := bob.nextFrame()
+		if json.Unmarshal(frame, &relayed) == nil && relayed["offer"] != nil {
+			break
+		}
+	}
+	if string(relayed["offer"]) != offer {
+		t.Fatalf("relayed offer differs: got %d bytes, want %d", len(relayed["offer"]), len(offer))
+	}
+	if string(relayed["from"]) != strconv.Quote(alice.id) || string(relayed["to"]) != strconv.Quote(bob.id) {
+		t.Fatalf("relayed from %s to %s, want from %q to %q", relayed["from"], relayed["to"], alice.id, bob.id)
+	}
+}
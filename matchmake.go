@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+)
+
+// findJoinableRoom picks a waiting room with the same options and a free
+// seat, preferring the fullest so players get packed into games instead of
+// spread thin. Must be called with h.lock held.
+func (h *Hub) findJoinableRoom(opts roomOptions) *Room {
+	var best *Room
+	bestCount := -1
+	for _, room := range h.rooms {
+		room.lock.RLock()
+		count := len(room.clients)
+		joinable := room.state == Waiting &&
+			room.password == nil &&
+			room.playsLikeLocked(opts) &&
+			(room.maxPlayers <= 0 || count < room.maxPlayers)
+		room.lock.RUnlock()
+		if !joinable {
+			continue
+		}
+		// Break ties on the id so the choice doesn't depend on map order
+		if count > bestCount || (count == bestCount && room.id < best.id) {
+			best, bestCount = room, count
+		}
+	}
+	return best
+}
+
+// playsLikeLocked reports whether the room plays the game the options
+// describe, with the server-wide flags standing in for options left unset
+// as they do in newRoom. Must be called with r.lock held.
+func (r *Room) playsLikeLocked(opts roomOptions) bool {
+	roundTimeout := *roundTimeout
+	if opts.roundTimeout > 0 {
+		roundTimeout = opts.roundTimeout
+	}
+	allowShotChange := *allowShotChange
+	if opts.allowShotChange != nil {
+		allowShotChange = *opts.allowShotChange
+	}
+	return r.gameMode == opts.mode &&
+		r.roundsToWin == opts.roundsToWin &&
+		r.bracket == opts.bracket &&
+		(r.tieBreak == tieBreakReshoot) == (opts.tieBreak == tieBreakReshoot) &&
+		r.roundTimeout == roundTimeout &&
+		r.allowShotChange == allowShotChange &&
+		r.autoStart == opts.autoStart
+}
+
+// matchmake finds or creates a room and seats the client in it. Choosing
+// the room and joining it happen under one hold of the hub lock, so two
+// players racing for the last seat can't both get it; the loser is placed
+// in another room instead.
+func (h *Hub) matchmake(opts roomOptions, c *Client, s seat) (*Room, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	room := h.findJoinableRoom(opts)
+	created := room == nil
+	if created {
+		var err error
+		if room, err = h.createRoom(h.generateRoomCode(), opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := room.addClient(c, s); err != nil {
+		if created {
+			h.deleteRoom(room.id)
+		}
+		return nil, err
+	}
+	if !c.spectator {
+		h.notifyLobby("player_count_changed", room.summary())
+	}
+	return room, nil
+}
+
+// matchmakeRoomID returns the id of a joinable room, creating an empty one
+// if none exist. It can't reserve a seat, so a client that loses the race
+// gets room_full on join and should ask again.
+func (h *Hub) matchmakeRoomID(opts roomOptions) (string, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	room := h.findJoinableRoom(opts)
+	if room == nil {
+		var err error
+		if room, err = h.createRoom(h.generateRoomCode(), opts); err != nil {
+			return "", err
+		}
+	}
+	return room.id, nil
+}
+
+// handleMatchmake takes the same options as join but lets the server pick
+// the room.
+func (c *Client) handleMatchmake(msg JoinMsg) {
+	opts, s, ok := c.parseJoin(msg)
+	if !ok {
+		return
+	}
+	c.leaveRoom()
+	room, err := hub.matchmake(opts, c, s)
+	roomID := ""
+	if room != nil {
+		roomID = room.id
+	}
+	c.completeJoin(roomID, room, err)
+}
+
+func matchmakeHandler(w http.ResponseWriter, r *http.Request) {
+	mode, ok := parseGameMode(r.URL.Query().Get("mode"))
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "unknown_mode"})
+		return
+	}
+	roomID, err := hub.matchmakeRoomID(roomOptions{mode: mode})
+	if err == errServerFull {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": "server_full"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"room": roomID})
+}
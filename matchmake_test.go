@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMatchmakeKeepsModesApart checks that matchmakers only meet players
+// who asked for the same game.
+func TestMatchmakeKeepsModesApart(t *testing.T) {
+	srv := newTestServer(t)
+	bracket := dialTest(t, srv, "")
+	bracketRoom := bracket.joinWith(`{"matchmake":true,"mode":"bracket"}`)["room"]
+	classic := dialTest(t, srv, "")
+	if room := classic.joinWith(`{"matchmake":true}`)["room"]; room == bracketRoom {
+		t.Fatalf("classic matchmaker put in bracket room %v", bracketRoom)
+	}
+
+	another := dialTest(t, srv, "")
+	if room := another.joinWith(`{"matchmake":true,"mode":"bracket"}`)["room"]; room != bracketRoom {
+		t.Fatalf("second bracket matchmaker put in %v, want %v", room, bracketRoom)
+	}
+	bracket.waitFor(fields{"new": another.id})
+}
+
+func TestPlaysLike(t *testing.T) {
+	reshoot := newRoom(t.Name(), roomOptions{mode: ClassicMode, tieBreak: tieBreakReshoot})
+	slow := newRoom(t.Name(), roomOptions{mode: ClassicMode, roundTimeout: time.Minute})
+	changeable := true
+	tests := []struct {
+		room *Room
+		opts roomOptions
+		want bool
+	}{
+		{newRoom(t.Name(), roomOptions{mode: ClassicMode}), roomOptions{mode: ClassicMode}, true},
+		{newRoom(t.Name(), roomOptions{mode: ClassicMode, tieBreak: tieBreakDraw}), roomOptions{mode: ClassicMode}, true},
+		{newRoom(t.Name(), roomOptions{mode: ClassicMode}), roomOptions{mode: LizardSpockMode}, false},
+		{newRoom(t.Name(), roomOptions{mode: ClassicMode, roundsToWin: 3}), roomOptions{mode: ClassicMode}, false},
+		{newRoom(t.Name(), roomOptions{mode: ClassicMode, bracket: true}), roomOptions{mode: ClassicMode}, false},
+		{reshoot, roomOptions{mode: ClassicMode}, false},
+		{reshoot, roomOptions{mode: ClassicMode, tieBreak: tieBreakReshoot}, true},
+		{slow, roomOptions{mode: ClassicMode}, false},
+		{newRoom(t.Name(), roomOptions{mode: ClassicMode, allowShotChange: &changeable}), roomOptions{mode: ClassicMode}, false},
+		{newRoom(t.Name(), roomOptions{mode: ClassicMode, autoStart: true}), roomOptions{mode: ClassicMode}, false},
+	}
+	for i, tt := range tests {
+		if got := tt.room.playsLikeLocked(tt.opts); got != tt.want {
+			t.Errorf("%d: playsLikeLocked = %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+// TestMatchmakeNotifiesLobby checks that lobby subscribers hear about a
+// room matchmaking creates and fills, as they do for a join.
+func TestMatchmakeNotifiesLobby(t *testing.T) {
+	srv := newTestServer(t)
+	browser := dialTest(t, srv, "")
+	browser.send(`{"lobby":true}`)
+	browser.expectNext(fields{"lobby": "rooms"})
+
+	// No other test plays best of seven, so this gets a room of its own
+	first := dialTest(t, srv, "")
+	roomID := first.joinWith(`{"matchmake":true,"mode":"bestof","rounds":7}`)["room"]
+	browser.expectNext(fields{"lobby": "room_created", "room": fields{"id": roomID, "playerCount": 0, "spectatorCount": 0, "state": "waiting", "private": false}})
+	browser.expectNext(fields{"lobby": "player_count_changed", "room": fields{"id": roomID, "playerCount": 1, "spectatorCount": 0, "state": "waiting", "private": false}})
+
+	another := dialTest(t, srv, "")
+	another.joinWith(`{"matchmake":true,"mode":"bestof","rounds":7}`)
+	browser.expectNext(fields{"lobby": "player_count_changed", "room": fields{"id": roomID, "playerCount": 2, "spectatorCount": 0, "state": "waiting", "private": false}})
+}
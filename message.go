@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// envelope is the typed message shape, {"type":"join","payload":{...}}.
+// The payload uses the same fields as the legacy message, so
+// {"type":"join","payload":{"join":"lobby"}} and {"join":"lobby"} mean the
+// same thing. Either shape may carry an "id", which is echoed on the reply.
+type envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// Requests from clients.
+
+// JoinMsg is shared by join and matchmake; Join is ignored by the latter.
+// Mode and Rounds only apply when the join creates the room.
+type JoinMsg struct {
+	Join   string `json:"join"`
+	Mode   string `json:"mode"`
+	Rounds *int   `json:"rounds"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	// Password is needed to join an invite-only room
+	Password string `json:"password"`
+}
+
+// SignalMsg is an offer, answer or ICE candidate. Everything but To is
+// relayed untouched, so the fields are kept raw.
+type SignalMsg struct {
+	To     string
+	Fields map[string]json.RawMessage
+}
+
+func (m *SignalMsg) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &m.Fields); err != nil {
+		return err
+	}
+	if to, ok := m.Fields["to"]; ok {
+		return json.Unmarshal(to, &m.To)
+	}
+	return nil
+}
+
+// FightMsg is {"fight":true}, or {"fight":"force"} from the owner.
+type FightMsg struct {
+	Fight interface{} `json:"fight"`
+}
+
+// ShootMsg is {"shoot":"rock"}, or {"shoot":1} from older clients.
+type ShootMsg struct {
+	Shoot ShootState `json:"shoot"`
+}
+
+type ChatMsg struct {
+	Chat string `json:"chat"`
+}
+
+// AddBotMsg is {"addBot":true}, or {"addBot":{"strategy":"frequency"}} to
+// pick how the bot plays.
+type AddBotMsg struct {
+	AddBot interface{} `json:"addBot"`
+}
+
+func (m AddBotMsg) strategy() string {
+	if options, ok := m.AddBot.(map[string]interface{}); ok {
+		if strategy, ok := options["strategy"].(string); ok && strategy != "" {
+			return strategy
+		}
+	}
+	return "random"
+}
+
+// RemoveBotMsg names the bot to remove, or is {"removeBot":true} for any.
+type RemoveBotMsg struct {
+	RemoveBot interface{} `json:"removeBot"`
+}
+
+// HandicapMsg sets how many rounds a player must win to knock anyone out.
+type HandicapMsg struct {
+	Handicap struct {
+		Player string `json:"player"`
+		Wins   int    `json:"wins"`
+	} `json:"handicap"`
+}
+
+// Responses to clients.
+
+type ErrorMsg struct {
+	Error  string `json:"error"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type JoinedMsg struct {
+	Joined        string   `json:"joined"`
+	Room          string   `json:"room"`
+	Name          string   `json:"name"`
+	Role          string   `json:"role"`
+	Session       string   `json:"session"`
+	Owner         string   `json:"owner"`
+	State         string   `json:"state"`
+	ActivePlayers []string `json:"activePlayers"`
+}
+
+type NewClientMsg struct {
+	New  string `json:"new"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type PlayersMsg struct {
+	Players []playerInfo `json:"players"`
+}
+
+type ResumedMsg struct {
+	Resumed string `json:"resumed"`
+	Name    string `json:"name"`
+	RoomID  string `json:"roomID"`
+	Session string `json:"session"`
+}
+
+// FightWaitingMsg tells the room who is holding up the start.
+type FightWaitingMsg struct {
+	Fight    string   `json:"fight"`
+	NotReady []string `json:"notReady"`
+	Ready    []string `json:"ready"`
+}
+
+type ShotMsg struct {
+	Shot   string     `json:"shot"`
+	Choice ShootState `json:"choice,omitempty"`
+}
+
+type ChatLine struct {
+	From string `json:"from"`
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+type ChatOutMsg struct {
+	Chat ChatLine `json:"chat"`
+}
+
+// ResultMsg reports how a round or game ended. Every result carries the
+// round's choices; the other fields depend on Result.
+type ResultMsg struct {
+	Result    string                `json:"result"`
+	Reason    string                `json:"reason,omitempty"`
+	Name      string                `json:"name,omitempty"`
+	Round     int                   `json:"round,omitempty"`
+	BeatenBy  []string              `json:"beatenBy,omitempty"`
+	Winner    string                `json:"winner,omitempty"`
+	Winners   []string              `json:"winners,omitempty"`
+	Losers    []string              `json:"losers,omitempty"`
+	Standings map[string]int        `json:"standings,omitempty"`
+	Choices   map[string]ShootState `json:"choices"`
+	// FocusResult is only sent to spectators following a player
+	FocusResult string `json:"focusResult,omitempty"`
+}
+
+type RematchTally struct {
+	Ready int `json:"ready"`
+	Total int `json:"total"`
+}
+
+type RematchMsg struct {
+	Rematch interface{} `json:"rematch"`
+}
+
+// marshal encodes a message for the wire. Encoding only fails on a
+// programming error, which is logged rather than sent.
+func marshal(v interface{}) []byte {
+	res, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Marshal error", "error", err)
+	}
+	return res
+}
+
+// handle adapts a handler taking a typed message to the dispatch table. A
+// message whose fields don't fit the type or break its rules is rejected
+// with a validation error before the handler runs.
+func handle[T any](handler func(*Client, T)) func(*Client, []byte) {
+	return func(c *Client, raw []byte) {
+		var msg T
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			var reqErr *requestError
+			if errors.As(err, &reqErr) {
+				c.sendError(reqErr.code, reqErr.detail)
+			} else if field, ok := typeError(err); ok {
+				c.sendValidationError([]fieldError{field})
+			} else {
+				c.sendError("invalid_message", err.Error())
+			}
+			c.noteInvalid()
+			return
+		}
+		if v, ok := any(msg).(validator); ok {
+			if fields := v.validate(); len(fields) > 0 {
+				c.sendValidationError(fields)
+				c.noteInvalid()
+				return
+			}
+		}
+		c.noteValid()
+		handler(c, msg)
+	}
+}
+
+var messageHandlers = map[string]func(*Client, []byte){
+	"join":          handle((*Client).handleJoin),
+	"matchmake":     handle((*Client).handleMatchmake),
+	"offer":         handle((*Client).handleSignal),
+	"answer":        handle((*Client).handleSignal),
+	"ice":           handle((*Client).handleSignal),
+	"leave":         func(c *Client, _ []byte) { c.handleLeave() },
+	"fight":         handle((*Client).handleFight),
+	"shoot":         handle((*Client).handleShoot),
+	"chat":          handle((*Client).handleChat),
+	"rematch":       func(c *Client, _ []byte) { c.handleRematch() },
+	"addBot":        handle((*Client).handleAddBot),
+	"removeBot":     handle((*Client).handleRemoveBot),
+	"handicap":      handle((*Client).handleHandicap),
+	"lobby":         handle((*Client).handleLobby),
+	"follow":        handle((*Client).handleFollow),
+	"spectate":      handle((*Client).handleSpectate),
+	"transferOwner": handle((*Client).handleTransferOwner),
+	"kick":          handle((*Client).handleKick),
+}
+
+var errUnknownType = errors.New("unknown message type")
+
+// decodeMessage works out the message type, the fields its handler reads
+// and the request id, if any. Typed envelopes are dispatched on their type;
+// legacy messages are recognised by their one handler key, and naming more
+// than one is rejected rather than picking one at random. The id is
+// returned even for a message that's rejected, so the error can carry it.
+func decodeMessage(message []byte) (string, []byte, json.RawMessage, error) {
+	var env envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		return "", nil, nil, err
+	}
+	id := requestID(env.ID)
+	if env.Type != "" {
+		if _, known := messageHandlers[env.Type]; !known {
+			return "", nil, id, errUnknownType
+		}
+		// Without a payload the fields sit next to the type, as they do
+		// when a client spreads an RTCSessionDescription into the message
+		if len(env.Payload) == 0 || string(env.Payload) == "null" {
+			return env.Type, message, id, nil
+		}
+		return env.Type, env.Payload, id, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return "", nil, id, err
+	}
+	var found []string
+	for key, value := range fields {
+		if _, known := messageHandlers[key]; known && string(value) != "null" {
+			found = append(found, key)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil, id, errUnknownType
+	case 1:
+		return found[0], message, id, nil
+	}
+	sort.Strings(found)
+	return "", nil, id, errors.New("message has more than one type: " + strings.Join(found, ", "))
+}
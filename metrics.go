@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	roomsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "shooting_rooms_total",
+		Help: "Number of rooms currently open.",
+	})
+	clientsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "shooting_clients_total",
+		Help: "Number of websocket clients currently connected.",
+	})
+	roundsPlayed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shooting_rounds_played_total",
+		Help: "Number of rounds resolved.",
+	})
+	gamesFinished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shooting_games_finished_total",
+		Help: "Number of games that ended with a winner.",
+	})
+	draws = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shooting_draws_total",
+		Help: "Number of rounds that ended in a draw.",
+	})
+	slowClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shooting_slow_clients_total",
+		Help: "Number of clients disconnected for not keeping up with their messages.",
+	})
+	droppedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shooting_dropped_messages_total",
+		Help: "Number of messages thrown away because a client's send buffer was full.",
+	})
+	webhookEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "shooting_webhook_events_dropped_total",
+		Help: "Number of webhook events dropped for a full queue or failed delivery.",
+	})
+)
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  string
+		allowAll bool
+		origin   string
+		want     bool
+	}{
+		{"exact match", "https://game.example", false, "https://game.example", true},
+		{"match ignores case and trailing slash", "https://Game.example/", false, "https://game.EXAMPLE", true},
+		{"one of several", "https://a.example, https://b.example", false, "https://b.example", true},
+		{"scheme mismatch", "https://game.example", false, "http://game.example", false},
+		{"port mismatch", "https://game.example", false, "https://game.example:8443", false},
+		{"other site", "https://game.example", false, "https://evil.example", false},
+		{"missing origin", "https://game.example", false, "", true},
+		{"missing origin without a list", "", false, "", true},
+		{"same origin without a list", "", false, "http://server.test", true},
+		{"cross origin without a list", "", false, "http://evil.example", false},
+		{"cross origin with allow-all", "", true, "http://evil.example", true},
+		{"list wins over allow-all", "https://game.example", true, "http://evil.example", false},
+	}
+	defer setFlag(&allowedOrigins, nil)()
+	defer setFlag(allowAllOrigins, false)()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowedOrigins = parseOrigins(tt.allowed)
+			*allowAllOrigins = tt.allowAll
+			r := httptest.NewRequest("GET", "http://server.test/", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkOrigin(r); got != tt.want {
+				t.Errorf("checkOrigin(%q) with allowed %q = %v, want %v", tt.origin, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOrigins(t *testing.T) {
+	got := parseOrigins(" https://A.example/ ,,http://b.example ")
+	want := []string{"https://a.example", "http://b.example"}
+	if len(got) != len(want) {
+		t.Fatalf("parseOrigins = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("parseOrigins = %q, want %q", got, want)
+		}
+	}
+}
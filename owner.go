@@ -0,0 +1,120 @@
+package main
+
+// TransferOwnerMsg hands the room's ownership to another player.
+type TransferOwnerMsg struct {
+	TransferOwner string `json:"transferOwner"`
+}
+
+func (m TransferOwnerMsg) validate() []fieldError {
+	if m.TransferOwner == "" {
+		return []fieldError{{Field: "transferOwner", Problem: "is required"}}
+	}
+	return nil
+}
+
+func (c *Client) handleTransferOwner(msg TransferOwnerMsg) {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	if err := room.transferOwner(c, msg.TransferOwner); err != "" {
+		c.sendError(err, "")
+	}
+}
+
+// transferOwner makes target the owner if from currently is, returning an
+// error code if not. The new owner must be a player; bots can't own rooms.
+func (r *Room) transferOwner(from *Client, target string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.ownerID != from.id {
+		return "not_owner"
+	}
+	client, exists := r.clients[target]
+	if !exists {
+		return "unknown_peer"
+	}
+	if client.bot != nil {
+		return "invalid_owner"
+	}
+	if target == r.ownerID {
+		return ""
+	}
+	r.ownerID = target
+	r.logger().Info("Ownership transferred", "event", "owner_transferred", "from", from.id, "to", target)
+	r.broadcastLocked(marshal(map[string]interface{}{"owner": target}))
+	return ""
+}
+
+// successorLocked picks the next owner when the owner leaves: the human
+// player who has been in the room longest, or "" if there is none. Must be
+// called with r.lock held.
+func (r *Room) successorLocked() string {
+	successor := ""
+	for id, client := range r.clients {
+		if client.bot != nil {
+			continue
+		}
+		if successor == "" || r.joinOrder[id] < r.joinOrder[successor] {
+			successor = id
+		}
+	}
+	return successor
+}
+
+// KickMsg names a member the owner wants out of the room.
+type KickMsg struct {
+	Kick string `json:"kick"`
+}
+
+func (m KickMsg) validate() []fieldError {
+	if m.Kick == "" {
+		return []fieldError{{Field: "kick", Problem: "is required"}}
+	}
+	return nil
+}
+
+// handleKick lets the owner remove a disruptive player or spectator. The
+// target is taken out of the room straight away, so a round it was holding
+// up resolves without it, and then disconnected.
+func (c *Client) handleKick(msg KickMsg) {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	target, isPlayer, errCode := room.kickTarget(c, msg.Kick)
+	if errCode != "" {
+		c.sendError(errCode, "")
+		return
+	}
+	room.logger().Info("Kicking member", "event", "kick", "client_id", target.id, "by", c.id)
+	target.enqueue(marshal(map[string]interface{}{"kicked": true}))
+	target.closeSendWith(closeKicked, "kicked by the room owner")
+	if !room.removeClient(target) {
+		return
+	}
+	if isPlayer {
+		hub.notifyLobby("player_count_changed", room.summary())
+	}
+	room.reevaluateRound()
+}
+
+// kickTarget looks up who the owner wants to kick, returning an error code
+// if they can't be.
+func (r *Room) kickTarget(owner *Client, targetID string) (*Client, bool, string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.ownerID != owner.id {
+		return nil, false, "not_owner"
+	}
+	if targetID == owner.id {
+		return nil, false, "cannot_kick_self"
+	}
+	if client, exists := r.clients[targetID]; exists {
+		return client, true, ""
+	}
+	if spectator, exists := r.spectators[targetID]; exists {
+		return spectator, false, ""
+	}
+	return nil, false, "unknown_peer"
+}
@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestTransferOwner(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	alice, bob, carol := players[0], players[1], players[2]
+
+	bob.sendf(`{"transferOwner":%q}`, carol.id)
+	bob.expectNext(fields{"error": "not_owner"})
+	alice.send(`{"transferOwner":"nobody"}`)
+	alice.expectNext(fields{"error": "unknown_peer"})
+
+	alice.sendf(`{"transferOwner":%q}`, bob.id)
+	for _, player := range players {
+		player.expectNext(fields{"owner": bob.id})
+	}
+	alice.sendf(`{"kick":%q}`, carol.id)
+	alice.expectNext(fields{"error": "not_owner"})
+	bob.sendf(`{"transferOwner":%q}`, carol.id)
+	for _, player := range players {
+		player.expectNext(fields{"owner": carol.id})
+	}
+}
+
+// TestOwnerLeaves checks that ownership passes to whoever has been in the
+// room longest.
+func TestOwnerLeaves(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	alice, bob, carol := players[0], players[1], players[2]
+
+	alice.send(`{"leave":true}`)
+	bob.waitFor(fields{"owner": bob.id})
+	carol.waitFor(fields{"owner": bob.id})
+
+	bob.close()
+	carol.waitFor(fields{"owner": carol.id})
+}
+
+// TestKickMidRound kicks the only player yet to shoot. The round resolves
+// between the other two.
+func TestKickMidRound(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 3)
+	alice, bob, carol := players[0], players[1], players[2]
+	startGame(t, players...)
+
+	alice.shoot("rock")
+	bob.shoot("scissors")
+	alice.sendf(`{"kick":%q}`, carol.id)
+	carol.waitFor(fields{"kicked": true})
+	if code := carol.expectClosed(); code != closeKicked {
+		t.Fatalf("close code = %d, want %d", code, closeKicked)
+	}
+	for _, player := range []*testClient{alice, bob} {
+		player.waitFor(fields{"result": "final_win", "winner": alice.id, "choices": map[string]ShootState{alice.id: Rock, bob.id: Scissors}})
+	}
+}
+
+// TestKickedClientCannotChat has the kicked client send a chat before its
+// socket closes. It's no longer in the room, so the chat goes nowhere.
+func TestKickedClientCannotChat(t *testing.T) {
+	alice, bob := newTestMember(t.Name()+"-alice"), newTestMember(t.Name()+"-bob")
+	for _, member := range []*Client{alice, bob} {
+		if _, err := hub.joinRoom(t.Name(), "", roomOptions{mode: ClassicMode}, member, seat{name: member.id}); err != nil {
+			t.Fatal(err)
+		}
+		member.roomID = t.Name()
+	}
+	defer alice.leaveRoom()
+	room := hub.lookupRoom(t.Name())
+	if _, _, errCode := room.kickTarget(alice, bob.id); errCode != "" {
+		t.Fatalf("kickTarget: %s", errCode)
+	}
+	room.removeClient(bob)
+
+	bob.handleChat(ChatMsg{Chat: "still here"})
+	if queued := queuedMessages(bob); !containsFrame(queued, fields{"error": "not_in_room"}) {
+		t.Fatalf("kicked client got %v, want not_in_room", queued)
+	}
+	if queued := queuedMessages(alice); containsFrame(queued, fields{"chat": anyValue}) {
+		t.Fatalf("owner got %v after the kick", queued)
+	}
+	if bob.roomID != "" {
+		t.Fatalf("kicked client's room = %q, want none", bob.roomID)
+	}
+}
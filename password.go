@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+)
+
+const maxPasswordLength = 128
+
+var errBadPassword = errors.New("wrong room password")
+
+// roomPassword protects an invite-only room. Only a salted hash of the
+// password is kept.
+type roomPassword struct {
+	salt []byte
+	hash []byte
+}
+
+func newRoomPassword(password string) *roomPassword {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return &roomPassword{salt: salt, hash: hashPassword(salt, password)}
+}
+
+func hashPassword(salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+func (p *roomPassword) matches(password string) bool {
+	return subtle.ConstantTimeCompare(hashPassword(p.salt, password), p.hash) == 1
+}
+
+// admits reports whether the password lets a client into the room. Rooms
+// without one are open to everyone.
+func (r *Room) admits(password string) bool {
+	return r.password == nil || r.password.matches(password)
+}
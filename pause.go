@@ -0,0 +1,60 @@
+package main
+
+// With -pause-on-disconnect, a heads-up game doesn't carry on without a
+// player whose connection drops mid-game. The room is paused for as long as
+// the player's seat is held for reconnect. If they come back the game picks
+// up with a fresh round; if the seat lapses they lose and the other player
+// wins.
+
+// pauseFor pauses the game for an active player who has dropped. It does
+// nothing unless the client is one of exactly two players left in a game.
+func (r *Room) pauseFor(c *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !*pauseOnDisconnect || r.state != Playing || r.activePlayers[c.id] != c || len(r.activePlayers) != 2 {
+		return
+	}
+	r.state = Paused
+	r.pausedFor = c.id
+	// The round in play is abandoned and replayed on resume, so the shots
+	// already made don't stand, nor does a result still being held back
+	r.closeRoundLocked(r.round)
+	r.stopRevealLocked()
+	r.logger().Info("Game paused for a dropped player", "event", "room_paused", "client_id", c.id)
+	r.broadcastLocked(marshal(map[string]interface{}{"room": "paused", "waitingFor": c.id}))
+}
+
+// resumeFor restarts a game paused for the client, now reconnected.
+func (r *Room) resumeFor(c *Client) {
+	r.lock.Lock()
+	if r.pausedFor != c.id || !r.unpauseLocked() {
+		r.lock.Unlock()
+		return
+	}
+	for _, client := range r.activePlayers {
+		client.shootState = None
+	}
+	r.logger().Info("Game resumed", "event", "room_resumed", "client_id", c.id)
+	r.broadcastLocked(marshal(map[string]interface{}{"room": "resumed"}))
+	r.lock.Unlock()
+
+	r.startRound()
+}
+
+// unpauseLocked puts a paused game back in play. Only the first caller gets
+// true, so a resume and a forfeit can't both go ahead. Must be called with
+// r.lock held.
+func (r *Room) unpauseLocked() bool {
+	if r.state != Paused {
+		return false
+	}
+	r.state = Playing
+	r.pausedFor = ""
+	return true
+}
+
+func (r *Room) unpause() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.unpauseLocked()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	defer setFlag(pauseOnDisconnect, true)()
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+	alice.shoot("rock")
+
+	alice.drop()
+	bob.waitFor(fields{"room": "paused", "waitingFor": alice.id})
+	bob.send(`{"shoot":"paper"}`)
+	bob.expectNext(fields{"error": "not_playing"})
+
+	again := dialTest(t, srv, "session="+alice.session)
+	again.waitFor(fields{"resumed": alice.id})
+	bob.expectNext(fields{"reconnected": alice.id})
+	bob.expectNext(fields{"room": "resumed"})
+	bob.expectNext(fields{"shoot": "go"})
+	again.waitFor(fields{"shoot": "go"})
+
+	// The shot made before the pause was thrown away
+	bob.shoot("paper")
+	bob.expectNone(fields{"result": anyValue}, 50*time.Millisecond)
+	again.shoot("scissors")
+	bob.waitFor(fields{"result": "final_win", "winner": alice.id})
+}
+
+func TestPauseTimesOut(t *testing.T) {
+	defer setFlag(pauseOnDisconnect, true)()
+	defer setFlag(reconnectGrace, 50*time.Millisecond)()
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+
+	alice.drop()
+	bob.waitFor(fields{"room": "paused", "waitingFor": alice.id})
+	bob.waitFor(fields{"result": "final_win", "winner": bob.id})
+}
+
+// TestPauseDuringReveal drops a player while a round's result is held back
+// by -reveal-delay. The result is abandoned with the round.
+func TestPauseDuringReveal(t *testing.T) {
+	defer setFlag(pauseOnDisconnect, true)()
+	defer setFlag(revealDelay, 200*time.Millisecond)()
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+
+	alice.shoot("rock")
+	bob.shoot("scissors")
+	alice.waitFor(fields{"reveal": 200})
+	alice.drop()
+	bob.waitFor(fields{"room": "paused", "waitingFor": alice.id})
+	bob.expectNone(fields{"result": anyValue}, 300*time.Millisecond)
+
+	again := dialTest(t, srv, "session="+alice.session)
+	again.waitFor(fields{"resumed": alice.id})
+	bob.waitFor(fields{"room": "resumed"})
+	bob.expectNext(fields{"shoot": "go"})
+	bob.shoot("rock")
+	again.shoot("paper")
+	bob.waitFor(fields{"result": "final_win", "winner": alice.id})
+}
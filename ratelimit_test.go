@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(10, 5)
+	for i := 0; i < 5; i++ {
+		if !b.allow(start) {
+			t.Fatalf("message %d of the burst refused", i+1)
+		}
+	}
+	if b.allow(start) {
+		t.Fatal("message past the burst allowed")
+	}
+	// 10 a second refills one token every 100ms
+	if !b.allow(start.Add(100 * time.Millisecond)) {
+		t.Fatal("refilled token refused")
+	}
+	if b.allow(start.Add(150 * time.Millisecond)) {
+		t.Fatal("half a token spent")
+	}
+	// A long pause refills no more than the burst
+	later := start.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		b.allow(later)
+	}
+	if b.allow(later) {
+		t.Fatal("bucket grew past its burst")
+	}
+}
+
+func TestTokenBucketDisabled(t *testing.T) {
+	b := newTokenBucket(0, 1)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if !b.allow(now) {
+			t.Fatal("disabled limit refused a message")
+		}
+	}
+}
+
+// TestRateLimitBurst floods the server and checks that most of the flood is
+// dropped, with the client told only once.
+func TestRateLimitBurst(t *testing.T) {
+	defer setFlag(messageRate, 20)()
+	defer setFlag(messageBurst, 40)()
+	srv := newTestServer(t)
+	client := dialTest(t, srv, "")
+
+	const sent = 100
+	for i := 0; i < sent; i++ {
+		client.send(`{"shoot":"rock"}`)
+	}
+	handled, notices := 0, 0
+	for {
+		select {
+		case data := <-client.frames:
+			msg := fields{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case msg.matches(fields{"error": "not_in_room"}):
+				handled++
+			case msg.matches(fields{"error": "rate_limited"}):
+				notices++
+			default:
+				t.Fatalf("unexpected frame %s", data)
+			}
+			continue
+		case <-time.After(200 * time.Millisecond):
+		}
+		break
+	}
+	// The burst plus whatever refilled while the flood was being read
+	if handled < 40 || handled >= sent/2 {
+		t.Errorf("%d of %d messages handled, want the burst of 40 and not many more", handled, sent)
+	}
+	if notices != 1 {
+		t.Errorf("got %d rate_limited notices, want 1", notices)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "time"
+
+// runReaper periodically closes rooms that have seen no activity for ttl.
+func (h *Hub) runReaper(ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.reapIdleRooms(now, ttl)
+	}
+}
+
+func (h *Hub) reapIdleRooms(now time.Time, ttl time.Duration) {
+	var evicted []*Client
+	h.lock.Lock()
+	for id, room := range h.rooms {
+		if now.Sub(room.lastActive()) < ttl {
+			continue
+		}
+		room.logger().Info("Reaping idle room", "event", "room_reaped")
+		evicted = append(evicted, room.members()...)
+		h.deleteRoom(id)
+	}
+	h.lock.Unlock()
+	evict(evicted, "idle", "room closed for inactivity")
+}
+
+// evict tells clients their room is gone and hangs up on them.
+func evict(clients []*Client, reason, closeText string) {
+	res := marshal(map[string]interface{}{"room": "closed", "reason": reason})
+	for _, client := range clients {
+		client.enqueue(res)
+		client.closeSendWith(closeRoomClosed, closeText)
+	}
+}
+
+func (r *Room) touch() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastActivity = time.Now()
+}
+
+func (r *Room) lastActive() time.Time {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.lastActivity
+}
+
+// members returns every player and spectator in the room.
+func (r *Room) members() []*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	members := make([]*Client, 0, len(r.clients)+len(r.spectators))
+	for _, client := range r.clients {
+		members = append(members, client)
+	}
+	for _, spectator := range r.spectators {
+		members = append(members, spectator)
+	}
+	return members
+}
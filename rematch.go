@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoRematch = errors.New("no rematch vote open")
+
+// handleRematch records the client's vote and starts a new game once every
+// player in the room has voted.
+func (c *Client) handleRematch() {
+	room := c.currentRoom()
+	if room == nil {
+		return
+	}
+	if c.spectator {
+		c.sendError("spectators_cannot_play", "")
+		return
+	}
+	allVoted, err := room.voteRematch(c)
+	if err == errNoRematch {
+		c.sendError("no_rematch", "")
+		return
+	}
+	if !allVoted {
+		return
+	}
+
+	started, err := room.tryStart(false)
+	if err != nil {
+		c.sendStartError(err)
+		return
+	}
+	if started {
+		room.startGame()
+	}
+}
+
+// openRematch starts collecting rematch votes after a game. Votes that
+// aren't all in within rematchTimeout are thrown away.
+func (r *Room) openRematch() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closeRematchLocked()
+	r.resetRematchVotesLocked()
+	r.rematchRound++
+	round := r.rematchRound
+	r.rematchTimer = time.AfterFunc(*rematchTimeout, func() { r.expireRematch(round) })
+}
+
+// voteRematch counts the vote and broadcasts the tally. When the vote is
+// unanimous it is closed and every player is marked ready, so the caller
+// only has to start the game.
+func (r *Room) voteRematch(c *Client) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.rematchVotes == nil {
+		return false, errNoRematch
+	}
+	r.rematchVotes[c.id] = true
+	r.broadcastRematchLocked()
+	if len(r.rematchVotes) < len(r.clients) {
+		return false, nil
+	}
+	for id := range r.clients {
+		r.ready[id] = true
+	}
+	r.closeRematchLocked()
+	return true, nil
+}
+
+func (r *Room) expireRematch(round int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.rematchRound != round || r.rematchVotes == nil {
+		return
+	}
+	r.closeRematchLocked()
+	r.broadcastLocked(marshal(RematchMsg{Rematch: "expired"}))
+}
+
+// resetRematchVotesLocked clears the votes, leaving bots voted since they
+// always want another game. Must be called with r.lock held.
+func (r *Room) resetRematchVotesLocked() {
+	r.rematchVotes = make(map[string]bool)
+	for id, client := range r.clients {
+		if client.bot != nil {
+			r.rematchVotes[id] = true
+		}
+	}
+}
+
+func (r *Room) closeRematch() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closeRematchLocked()
+}
+
+func (r *Room) closeRematchLocked() {
+	if r.rematchTimer != nil {
+		r.rematchTimer.Stop()
+		r.rematchTimer = nil
+	}
+	r.rematchVotes = nil
+}
+
+// broadcastRematchLocked must be called with r.lock held.
+func (r *Room) broadcastRematchLocked() {
+	r.broadcastLocked(marshal(RematchMsg{Rematch: RematchTally{Ready: len(r.rematchVotes), Total: len(r.clients)}}))
+}
@@ -0,0 +1,41 @@
+package main
+
+import "encoding/json"
+
+// maxRequestIDLength bounds the "id" a client may attach to a request.
+const maxRequestIDLength = 64
+
+// requestID returns the message's "id" if it's a string or a number short
+// enough to echo back, or nil.
+func requestID(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 || len(raw) > maxRequestIDLength {
+		return nil
+	}
+	switch c := raw[0]; {
+	case c == '"', c == '-', c >= '0' && c <= '9':
+		return raw
+	}
+	return nil
+}
+
+// reply queues a direct answer to the request being handled, tagged with
+// the request's id, if it had one, so the client can match the two up.
+// Broadcasts and relayed messages aren't replies and go out untagged.
+func (c *Client) reply(message []byte) {
+	c.enqueue(withRequestID(message, c.requestID))
+}
+
+// withRequestID adds an "id" field to a JSON object. Like withSeq, it
+// returns a copy.
+func withRequestID(message []byte, id json.RawMessage) []byte {
+	if id == nil || len(message) < 2 || message[0] != '{' {
+		return message
+	}
+	out := make([]byte, 0, len(message)+len(id)+6)
+	out = append(out, `{"id":`...)
+	out = append(out, id...)
+	if message[1] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, message[1:]...)
+}
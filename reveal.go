@@ -0,0 +1,92 @@
+package main
+
+import "time"
+
+// roundOutcome is a round's result, captured as the round closes so that
+// players leaving during the reveal delay can't change it.
+type roundOutcome struct {
+	choices    map[string]ShootState
+	winners    []*Client
+	losers     []*Client
+	drawReason string
+}
+
+func (r *Room) scoreRound() roundOutcome {
+	// Snapshot the choices before eliminations and the reset wipe them
+	choices := r.thrownChoices()
+	var winners, losers []*Client
+	var drawReason string
+	if r.bracket {
+		winners, losers, drawReason = r.determineBracketResults()
+	} else {
+		winners, losers, drawReason = r.determineWinnersAndLosers()
+	}
+	return roundOutcome{choices: choices, winners: winners, losers: losers, drawReason: drawReason}
+}
+
+// revealRound settles a round everyone has shot in, after -reveal-delay so
+// clients can play their animations in step.
+func (r *Room) revealRound() {
+	if *revealDelay <= 0 {
+		r.resolveRound(nil)
+		return
+	}
+	outcome := r.scoreRound()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	round := r.round
+	r.revealTimer = time.AfterFunc(*revealDelay, func() { r.finishReveal(round, outcome) })
+	r.broadcastLocked(marshal(map[string]interface{}{"reveal": revealDelay.Milliseconds()}))
+}
+
+func (r *Room) finishReveal(round int, outcome roundOutcome) {
+	r.lock.Lock()
+	if r.revealTimer == nil || r.round != round {
+		r.lock.Unlock()
+		return
+	}
+	r.revealTimer = nil
+	// Players who left while the result was held back are out of it
+	outcome.winners = r.stillActiveLocked(outcome.winners)
+	outcome.losers = r.stillActiveLocked(outcome.losers)
+	if len(outcome.winners) == 0 {
+		// Every winner has gone, so the round is replayed as a draw
+		for _, client := range r.activePlayers {
+			outcome.winners = append(outcome.winners, client)
+		}
+		outcome.losers = nil
+	}
+	remaining := len(r.activePlayers)
+	r.lock.Unlock()
+
+	switch {
+	case remaining == 1:
+		r.finishGame(r.getFinalWinner(), outcome.choices)
+	case remaining > 1:
+		r.settleRound(outcome, nil)
+	}
+}
+
+// stillActiveLocked must be called with r.lock held.
+func (r *Room) stillActiveLocked(clients []*Client) []*Client {
+	var active []*Client
+	for _, client := range clients {
+		if r.activePlayers[client.id] != nil {
+			active = append(active, client)
+		}
+	}
+	return active
+}
+
+func (r *Room) stopReveal() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stopRevealLocked()
+}
+
+func (r *Room) stopRevealLocked() {
+	if r.revealTimer != nil {
+		r.revealTimer.Stop()
+		r.revealTimer = nil
+	}
+}
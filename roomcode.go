@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+)
+
+// roomCodeAlphabet is base32 without 0, 1, I and O, so codes survive being
+// read aloud or typed from a screenshot.
+const (
+	roomCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	roomCodeLength   = 6
+)
+
+// generateRoomCode returns a short room code not used by any open room.
+// Must be called with h.lock held so the code can't be taken before the
+// room is created.
+func (h *Hub) generateRoomCode() string {
+	for {
+		code := randomRoomCode()
+		if _, taken := h.rooms[code]; !taken {
+			return code
+		}
+	}
+}
+
+func randomRoomCode() string {
+	var b [roomCodeLength]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	// 256 is a multiple of 32, so masking keeps the letters uniform
+	for i := range b {
+		b[i] = roomCodeAlphabet[b[i]&31]
+	}
+	return string(b[:])
+}
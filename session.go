@@ -0,0 +1,160 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Sessions let a player who drops off the network reconnect with the same
+// identity. Each client gets a session token on connect; when its socket
+// dies while it's in a room, the seat is held for -reconnect-grace and a new
+// socket presenting the token takes it over.
+
+func newSessionToken() string {
+	return uuid.New().String()
+}
+
+func (h *Hub) startSession(c *Client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sessions[c.session] = c
+}
+
+func (h *Hub) endSession(c *Client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.sessions[c.session] == c {
+		delete(h.sessions, c.session)
+	}
+}
+
+// holdSession keeps a disconnected client's seat until the grace window
+// lapses.
+func (h *Hub) holdSession(c *Client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	c.graceTimer = time.AfterFunc(*reconnectGrace, func() { h.expireSession(c) })
+}
+
+func (h *Hub) expireSession(c *Client) {
+	h.lock.Lock()
+	if h.sessions[c.session] != c {
+		h.lock.Unlock()
+		return
+	}
+	delete(h.sessions, c.session)
+	h.lock.Unlock()
+
+	c.logger().Info("Reconnect window lapsed", "event", "session_expired")
+	c.leaveRoom()
+}
+
+// resumeSession hands the identity and seat of a session over to the
+// freshly connected client. A client often reconnects before the server has
+// noticed its old socket is dead, so a session that is still connected is
+// taken over too, after closing the stale connection. It returns false if
+// the token is unknown or already expired.
+func (h *Hub) resumeSession(token string, c *Client) bool {
+	h.lock.RLock()
+	old, exists := h.sessions[token]
+	h.lock.RUnlock()
+	if exists && old.bot == nil {
+		old.closeStale()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	old, exists = h.sessions[token]
+	if !exists {
+		return false
+	}
+	if !old.replaced.Load() && (old.graceTimer == nil || !old.graceTimer.Stop()) {
+		return false
+	}
+
+	c.id = old.id
+	c.name = old.name
+	c.session = old.session
+	c.spectator = old.spectator
+	c.roomID = old.roomID
+	h.sessions[token] = c
+	if room, exists := h.rooms[c.roomID]; exists {
+		room.replaceClient(old, c)
+	} else {
+		c.roomID = ""
+	}
+	return true
+}
+
+// replaceClient swaps a reconnected client in for its old connection,
+// keeping its place among the active players.
+func (r *Room) replaceClient(old, c *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c.shootState = old.shootState
+	if _, exists := r.clients[old.id]; exists {
+		r.clients[old.id] = c
+	}
+	if _, exists := r.spectators[old.id]; exists {
+		r.spectators[old.id] = c
+	}
+	if _, exists := r.activePlayers[old.id]; exists {
+		r.activePlayers[old.id] = c
+	}
+}
+
+// closeStale hangs up a connection whose session is being resumed elsewhere
+// and waits for its read pump to finish, so nothing it was still doing
+// races with the takeover. Its seat is left for the new connection. Once
+// the client has gone, this does nothing.
+func (c *Client) closeStale() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if c.replaced.Swap(true) {
+		<-c.done
+		return
+	}
+	c.connLogger().Info("Closing stale connection for reconnect", "event", "session_replaced")
+	c.closeSendWith(closeReplaced, "session resumed on another connection")
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		// The old peer isn't reading; drop the socket without the close
+		// handshake
+		c.cancel()
+		<-c.done
+	}
+}
+
+// disconnect runs once the client's socket is gone. A client in a room keeps
+// its seat for the grace window so it can reconnect, unless it closed the
+// connection normally and so isn't coming back, or has no seat left to
+// keep because it was kicked or its room is gone.
+func (c *Client) disconnect(graceful bool) {
+	if c.replaced.Load() {
+		// A reconnect is taking over the seat
+		return
+	}
+	room := hub.lookupRoom(c.roomID)
+	if graceful || c.roomID == "" || *reconnectGrace <= 0 || shuttingDown.Load() || room == nil || !room.hasClient(c) {
+		c.leaveRoom()
+		hub.endSession(c)
+		return
+	}
+	c.logger().Info("Holding seat for reconnect", "event", "session_held")
+	hub.holdSession(c)
+	room.pauseFor(c)
+}
+
+func (c *Client) sendResumed() {
+	c.enqueue(marshal(ResumedMsg{Resumed: c.id, Name: c.name, RoomID: c.roomID, Session: c.session}))
+	if room := hub.lookupRoom(c.roomID); room != nil {
+		c.enqueue(marshal(PlayersMsg{Players: room.players()}))
+		room.broadcastExcept(marshal(map[string]interface{}{"reconnected": c.id}), c)
+		room.resumeFor(c)
+	}
+}
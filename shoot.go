@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var shootNames = map[string]ShootState{
+	"rock":     Rock,
+	"paper":    Paper,
+	"scissors": Scissors,
+	"lizard":   Lizard,
+	"spock":    Spock,
+}
+
+// parseShoot reads a choice sent either by name, like "rock", or by its
+// number, which older clients send. Whether the choice is legal in the
+// room's mode is checked later, with the same invalid_shoot error.
+func parseShoot(v interface{}) (ShootState, error) {
+	switch v := v.(type) {
+	case string:
+		if choice, ok := shootNames[strings.ToLower(v)]; ok {
+			return choice, nil
+		}
+		return None, fmt.Errorf("unknown choice %q", v)
+	case float64:
+		if v != math.Trunc(v) || v < float64(Rock) || v > float64(Spock) {
+			return None, fmt.Errorf("%v is not a choice; send rock, paper, scissors, lizard or spock, or a number from %d to %d", v, Rock, Spock)
+		}
+		return ShootState(v), nil
+	}
+	return None, fmt.Errorf("choice must be a name or a number")
+}
+
+func (s *ShootState) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	choice, err := parseShoot(v)
+	if err != nil {
+		return &requestError{code: "invalid_shoot", detail: err.Error()}
+	}
+	*s = choice
+	return nil
+}
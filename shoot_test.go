@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// TestInvalidShoot sends choices that aren't legal and checks each is
+// refused without using up the player's shot.
+func TestInvalidShoot(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+
+	tests := []struct {
+		shoot string
+		want  fields
+	}{
+		{`99`, fields{"error": "invalid_shoot", "detail": fmt.Sprintf("99 is not a choice; send rock, paper, scissors, lizard or spock, or a number from %d to %d", Rock, Spock)}},
+		{`-1`, fields{"error": "invalid_shoot"}},
+		{`0`, fields{"error": "invalid_shoot"}},
+		{`2147483648`, fields{"error": "invalid_shoot"}},
+		{`1.5`, fields{"error": "invalid_shoot"}},
+		{`"1"`, fields{"error": "invalid_shoot"}},
+		{`"fire"`, fields{"error": "invalid_shoot"}},
+		{`true`, fields{"error": "invalid_shoot"}},
+		{`null`, fields{"error": "invalid_shoot"}},
+		{`[1]`, fields{"error": "invalid_shoot"}},
+		{`{"choice":1}`, fields{"error": "invalid_shoot"}},
+		// Legal in rpsls rooms only
+		{`4`, fields{"error": "invalid_shoot"}},
+		{`"spock"`, fields{"error": "invalid_shoot"}},
+	}
+	for _, tt := range tests {
+		alice.sendf(`{"type":"shoot","payload":{"shoot":%s}}`, tt.shoot)
+		if msg := alice.next(); !msg.matches(tt.want) {
+			t.Errorf("shoot %s: got %v, want %v", tt.shoot, msg, tt.want)
+		}
+	}
+
+	// None of that counted as a shot
+	alice.shoot("rock")
+	bob.shoot("scissors")
+	bob.waitFor(fields{"result": "final_win", "winner": alice.id})
+}
+
+// TestShotLocked checks that by default a player's first shot stands.
+func TestShotLocked(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+
+	alice.shoot("rock")
+	alice.send(`{"shoot":"paper"}`)
+	alice.waitFor(fields{"error": "already_shot"})
+	bob.shoot("paper")
+	alice.waitFor(fields{"result": "final_win", "winner": bob.id})
+}
+
+// TestShotChangeable checks that with -allow-shot-change the last shot
+// before the round resolves is the one that counts.
+func TestShotChangeable(t *testing.T) {
+	defer setFlag(allowShotChange, true)()
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+
+	alice.shoot("rock")
+	alice.send(`{"shoot":"paper"}`)
+	alice.waitFor(fields{"shot": "accepted", "choice": Paper})
+	bob.shoot("rock")
+	alice.waitFor(fields{"result": "final_win", "winner": alice.id})
+}
+
+// TestShootNamesAndNumbers plays a round with one player sending a name
+// and the other a number.
+func TestShootNamesAndNumbers(t *testing.T) {
+	srv := newTestServer(t)
+	players := joinPlayers(t, srv, t.Name(), 2)
+	alice, bob := players[0], players[1]
+	startGame(t, alice, bob)
+
+	alice.send(`{"shoot":"Paper"}`)
+	alice.expectNext(fields{"shot": "accepted", "choice": Paper})
+	bob.sendf(`{"shoot":%d}`, Rock)
+	bob.expectNext(fields{"shot": "accepted", "choice": Rock})
+	bob.waitFor(fields{"result": "final_win", "winner": alice.id, "choices": map[string]ShootState{alice.id: Paper, bob.id: Rock}})
+}
+
+func TestParseShoot(t *testing.T) {
+	tests := []struct {
+		in      interface{}
+		want    ShootState
+		wantErr bool
+	}{
+		{"rock", Rock, false},
+		{"SCISSORS", Scissors, false},
+		{"Spock", Spock, false},
+		{"fire", None, true},
+		{"", None, true},
+		{"2", None, true},
+		{float64(Paper), Paper, false},
+		{float64(Spock), Spock, false},
+		{float64(None), None, true},
+		{float64(99), None, true},
+		{float64(-1), None, true},
+		{float64(math.MaxInt32) + 1, None, true},
+		{1.5, None, true},
+		{true, None, true},
+		{nil, None, true},
+		{[]interface{}{float64(1)}, None, true},
+	}
+	for _, tt := range tests {
+		got, err := parseShoot(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseShoot(%#v) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
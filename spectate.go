@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Watching lets one connection, such as a caster's, follow several rooms at
+// once without joining any of them. Watchers aren't members: they get a copy
+// of everything broadcast in each room they watch, wrapped with the room's
+// id so the streams can be told apart.
+
+// SpectateMsg replaces the set of rooms the client watches; an empty list
+// stops watching. Password is tried on every invite-only room named.
+type SpectateMsg struct {
+	Spectate []string `json:"spectate"`
+	Password string   `json:"password"`
+}
+
+// SpectatingMsg lists the rooms now watched. Refused maps each room that
+// wouldn't take the watcher to an error code.
+type SpectatingMsg struct {
+	Spectating []string          `json:"spectating"`
+	NotFound   []string          `json:"notFound,omitempty"`
+	Refused    map[string]string `json:"refused,omitempty"`
+}
+
+// SpectateEventMsg is a message broadcast in a watched room.
+type SpectateEventMsg struct {
+	Room  string          `json:"room"`
+	Event json.RawMessage `json:"event"`
+}
+
+func (m SpectateMsg) validate() []fieldError {
+	if len(m.Spectate) > *maxSpectate {
+		return []fieldError{{Field: "spectate", Problem: fmt.Sprintf("must name at most %d rooms", *maxSpectate)}}
+	}
+	for _, roomID := range m.Spectate {
+		if roomID == "" {
+			return []fieldError{{Field: "spectate", Problem: "must not contain empty room ids"}}
+		}
+	}
+	return nil
+}
+
+// handleSpectate watches the named rooms that exist and stops watching the
+// rest. Players can't watch other rooms while they have a game of their own.
+func (c *Client) handleSpectate(msg SpectateMsg) {
+	if c.memberRoom() != nil && !c.spectator {
+		c.sendError("not_spectator", "")
+		return
+	}
+	wanted := make(map[string]bool, len(msg.Spectate))
+	for _, roomID := range msg.Spectate {
+		wanted[roomID] = true
+	}
+	for roomID := range c.spectating {
+		if !wanted[roomID] {
+			c.unwatch(roomID)
+		}
+	}
+
+	res := SpectatingMsg{Spectating: []string{}}
+	for roomID := range wanted {
+		room := hub.lookupRoom(roomID)
+		if room == nil {
+			delete(c.spectating, roomID)
+			res.NotFound = append(res.NotFound, roomID)
+			continue
+		}
+		if roomID != c.roomID {
+			// The room the client spectates as a member already sends it
+			// everything
+			if err := room.watch(c, msg.Password); err != nil {
+				delete(c.spectating, roomID)
+				if res.Refused == nil {
+					res.Refused = make(map[string]string)
+				}
+				res.Refused[roomID] = watchErrorCode(err)
+				continue
+			}
+		}
+		c.spectating[roomID] = true
+		res.Spectating = append(res.Spectating, roomID)
+	}
+	sort.Strings(res.Spectating)
+	sort.Strings(res.NotFound)
+	c.reply(marshal(res))
+}
+
+func (c *Client) unwatch(roomID string) {
+	delete(c.spectating, roomID)
+	if room := hub.lookupRoom(roomID); room != nil {
+		room.unwatch(c)
+	}
+}
+
+// unwatchAll drops every subscription when the connection goes away.
+func (c *Client) unwatchAll() {
+	for roomID := range c.spectating {
+		c.unwatch(roomID)
+	}
+}
+
+// watch adds the client to the room's watchers. Watchers see the room's
+// chat, so an invite-only room needs its password.
+func (r *Room) watch(c *Client, password string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.admits(password) {
+		r.unwatchLocked(c)
+		return errBadPassword
+	}
+	if _, watching := r.watchers[c.id]; !watching && *maxWatchers > 0 && len(r.watchers) >= *maxWatchers {
+		return errWatchersFull
+	}
+	r.watchers[c.id] = c
+	return nil
+}
+
+func watchErrorCode(err error) string {
+	if err == errBadPassword {
+		return "bad_password"
+	}
+	return "watchers_full"
+}
+
+func (r *Room) unwatch(c *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.unwatchLocked(c)
+}
+
+// unwatchLocked must be called with r.lock held.
+func (r *Room) unwatchLocked(c *Client) {
+	if r.watchers[c.id] == c {
+		delete(r.watchers, c.id)
+	}
+}
+
+func (r *Room) relay(message []byte) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	r.relayLocked(message)
+}
+
+// relayLocked passes a broadcast on to the room's watchers. Must be called
+// with r.lock held.
+func (r *Room) relayLocked(message []byte) {
+	if len(r.watchers) == 0 {
+		return
+	}
+	wrapped := marshal(SpectateEventMsg{Room: r.id, Event: message})
+	for _, watcher := range r.watchers {
+		watcher.enqueue(wrapped)
+	}
+}
+
+// broadcastWatchers sends a message of the room's own, rather than a relayed
+// broadcast, to its watchers.
+func (r *Room) broadcastWatchers(message []byte) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, watcher := range r.watchers {
+		watcher.enqueue(message)
+	}
+}
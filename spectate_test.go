@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSpectatePasswordRoom checks that watching an invite-only room, which
+// would show its chat, needs the room's password.
+func TestSpectatePasswordRoom(t *testing.T) {
+	srv := newTestServer(t)
+	resp, err := http.Post(srv.URL+"/rooms", "application/json", strings.NewReader(`{"id":"`+t.Name()+`","password":"secret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create room: status %d", resp.StatusCode)
+	}
+	alice := dialTest(t, srv, "")
+	alice.joinWith(`{"join":"` + t.Name() + `","password":"secret"}`)
+	watcher := dialTest(t, srv, "")
+
+	watcher.sendf(`{"spectate":[%q]}`, t.Name())
+	watcher.expectNext(fields{"spectating": []string{}, "refused": map[string]string{t.Name(): "bad_password"}})
+	watcher.sendf(`{"spectate":[%q],"password":"guess"}`, t.Name())
+	watcher.expectNext(fields{"spectating": []string{}, "refused": map[string]string{t.Name(): "bad_password"}})
+	alice.send(`{"chat":"private"}`)
+	watcher.expectNone(fields{"room": t.Name()}, 50*time.Millisecond)
+
+	watcher.sendf(`{"spectate":[%q],"password":"secret"}`, t.Name())
+	watcher.expectNext(fields{"spectating": []string{t.Name()}})
+	alice.send(`{"chat":"welcome"}`)
+	watcher.waitFor(fields{"room": t.Name(), "event": fields{"chat": fields{"from": alice.id, "name": alice.id[:8], "text": "welcome"}}})
+}
+
+func TestSpectateWatcherLimit(t *testing.T) {
+	defer setFlag(maxWatchers, 1)()
+	srv := newTestServer(t)
+	alice := dialTest(t, srv, "")
+	alice.join(t.Name())
+	first, second := dialTest(t, srv, ""), dialTest(t, srv, "")
+
+	first.sendf(`{"spectate":[%q]}`, t.Name())
+	first.expectNext(fields{"spectating": []string{t.Name()}})
+	// Asking again doesn't count twice
+	first.sendf(`{"spectate":[%q]}`, t.Name())
+	first.expectNext(fields{"spectating": []string{t.Name()}})
+	second.sendf(`{"spectate":[%q]}`, t.Name())
+	second.expectNext(fields{"spectating": []string{}, "refused": map[string]string{t.Name(): "watchers_full"}})
+
+	first.send(`{"spectate":[]}`)
+	first.expectNext(fields{"spectating": []string{}})
+	second.sendf(`{"spectate":[%q]}`, t.Name())
+	second.expectNext(fields{"spectating": []string{t.Name()}})
+}
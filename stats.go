@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// gamesFinishedTotal mirrors the games_finished counter for /stats, so the
+// summary doesn't have to read it back out of Prometheus.
+var gamesFinishedTotal atomic.Int64
+
+// serverStats is a human-readable summary for dashboards that don't scrape
+// /metrics.
+type serverStats struct {
+	Rooms             int            `json:"rooms"`
+	Players           int            `json:"players"`
+	RoomsByState      map[string]int `json:"roomsByState"`
+	AvgPlayersPerRoom float64        `json:"avgPlayersPerRoom"`
+	GamesFinished     int64          `json:"gamesFinished"`
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, hub.hubStats())
+}
+
+// hubStats totals up the rooms under the hub lock. The result is encoded
+// after the lock is released.
+func (h *Hub) hubStats() serverStats {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	stats := serverStats{
+		Rooms:         len(h.rooms),
+		RoomsByState:  map[string]int{Waiting.String(): 0, Playing.String(): 0, Paused.String(): 0},
+		GamesFinished: gamesFinishedTotal.Load(),
+	}
+	for _, room := range h.rooms {
+		summary := room.summary()
+		stats.Players += summary.PlayerCount
+		stats.RoomsByState[summary.State]++
+	}
+	if stats.Rooms > 0 {
+		stats.AvgPlayersPerRoom = float64(stats.Players) / float64(stats.Rooms)
+	}
+	return stats
+}
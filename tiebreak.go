@@ -0,0 +1,32 @@
+package main
+
+// Tie-break modes for standoff rounds, where every choice thrown was beaten
+// by another. By default a standoff is a draw and the next round starts;
+// with tieBreakReshoot the same round is shot again straight away, on a
+// shorter clock.
+const (
+	tieBreakDraw    = "draw"
+	tieBreakReshoot = "reshoot"
+)
+
+func validTieBreak(mode string) bool {
+	return mode == "" || mode == tieBreakDraw || mode == tieBreakReshoot
+}
+
+// reshootRound reopens the current round after a standoff without moving
+// the round counter on, so history and round numbers only see the decider.
+func (r *Room) reshootRound(choices map[string]ShootState) {
+	r.lock.Lock()
+	r.roundOpen = true
+	r.acceptingShots = false
+	r.reshoot = true
+	r.shot = make(map[string]bool)
+	for _, client := range r.activePlayers {
+		client.shootState = None
+	}
+	round := r.round
+	r.broadcastLocked(marshal(ResultMsg{Result: "reshoot", Reason: drawStandoff, Choices: choices}))
+	r.lock.Unlock()
+
+	r.countdown(round, min(*countdownFrom, 1))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+func tlsEnabled() bool {
+	return *tlsCert != "" && *tlsKey != ""
+}
+
+// redirectHandler serves the plain-HTTP side of a TLS deployment. Browsers
+// get redirected to https, while websocket clients, which can't follow
+// redirects during the handshake, get told to use wss instead.
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(*addr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "this server only accepts secure connections, use wss://"+host+r.URL.RequestURI(), http.StatusUpgradeRequired)
+		return
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+func listen(srv *http.Server) error {
+	if tlsEnabled() {
+		return srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	}
+	return srv.ListenAndServe()
+}
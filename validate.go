@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// fieldError names a field of a request and what is wrong with it.
+type fieldError struct {
+	Field   string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+type ValidationMsg struct {
+	Error  string       `json:"error"`
+	Fields []fieldError `json:"fields"`
+}
+
+// validator is implemented by requests with rules beyond what decoding
+// checks. handle runs it before the handler, so handlers can trust the
+// shape of what they get and only check it against the room.
+type validator interface {
+	validate() []fieldError
+}
+
+// requestError is returned while decoding a request that should be refused
+// with its own error code rather than as invalid or failing validation.
+type requestError struct {
+	code   string
+	detail string
+}
+
+func (e *requestError) Error() string {
+	return e.code + ": " + e.detail
+}
+
+func (c *Client) sendValidationError(fields []fieldError) {
+	c.reply(marshal(ValidationMsg{Error: "validation", Fields: fields}))
+}
+
+// typeError turns a decoding error caused by a field of the wrong type into
+// a field error.
+func typeError(err error) (fieldError, bool) {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Field == "" {
+		return fieldError{}, false
+	}
+	return fieldError{Field: typeErr.Field, Problem: "must be " + jsonKind(typeErr.Type.Kind().String())}, true
+}
+
+func jsonKind(kind string) string {
+	switch kind {
+	case "string":
+		return "a string"
+	case "bool":
+		return "a boolean"
+	case "struct", "map":
+		return "an object"
+	case "slice", "array":
+		return "an array"
+	}
+	return "a number"
+}
+
+func (m JoinMsg) validate() []fieldError {
+	var fields []fieldError
+	if _, err := parseRoomMode(m.Mode, m.Rounds); err != nil {
+		field := "mode"
+		if m.Mode == "bestof" {
+			field = "rounds"
+		}
+		fields = append(fields, fieldError{Field: field, Problem: err.Error()})
+	}
+	if utf8.RuneCountInString(sanitizeName(m.Name)) > maxNameLength {
+		fields = append(fields, fieldError{Field: "name", Problem: fmt.Sprintf("must be at most %d characters", maxNameLength)})
+	}
+	if m.Role != "" && m.Role != "player" && m.Role != "spectator" {
+		fields = append(fields, fieldError{Field: "role", Problem: "must be player or spectator"})
+	}
+	return fields
+}
+
+func (m ChatMsg) validate() []fieldError {
+	if utf8.RuneCountInString(stripControl(m.Chat)) > maxChatLength {
+		return []fieldError{{Field: "chat", Problem: fmt.Sprintf("must be at most %d characters", maxChatLength)}}
+	}
+	return nil
+}
+
+func (m SignalMsg) validate() []fieldError {
+	if m.To == "" {
+		return []fieldError{{Field: "to", Problem: "is required"}}
+	}
+	return nil
+}
+
+func (m AddBotMsg) validate() []fieldError {
+	if _, ok := botStrategies[m.strategy()]; !ok {
+		return []fieldError{{Field: "addBot.strategy", Problem: "must be one of " + strings.Join(botStrategyNames(), ", ")}}
+	}
+	return nil
+}
+
+func (m HandicapMsg) validate() []fieldError {
+	var fields []fieldError
+	if m.Handicap.Player == "" {
+		fields = append(fields, fieldError{Field: "handicap.player", Problem: "is required"})
+	}
+	if m.Handicap.Wins < 1 || m.Handicap.Wins > maxHandicap {
+		fields = append(fields, fieldError{Field: "handicap.wins", Problem: fmt.Sprintf("must be between 1 and %d", maxHandicap)})
+	}
+	return fields
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// With -webhook-url, significant room events are POSTed there as JSON for
+// integrations. Events are queued and sent by a single goroutine, so a slow
+// or failing webhook never holds up a game. When the queue is full the
+// oldest event is dropped.
+
+const (
+	webhookQueueSize = 1000
+	webhookTimeout   = 5 * time.Second
+	webhookAttempts  = 4
+	webhookBackoff   = 500 * time.Millisecond
+)
+
+type webhookEvent struct {
+	Event string      `json:"event"`
+	Room  string      `json:"room"`
+	At    time.Time   `json:"at"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+type webhookDispatcher struct {
+	lock   sync.Mutex
+	queue  []webhookEvent
+	wake   chan struct{}
+	client *http.Client
+}
+
+var webhooks = &webhookDispatcher{
+	wake:   make(chan struct{}, 1),
+	client: &http.Client{Timeout: webhookTimeout},
+}
+
+// emitEvent queues an event for the webhook. It never blocks.
+func emitEvent(event, roomID string, data interface{}) {
+	if *webhookURL == "" {
+		return
+	}
+	webhooks.push(webhookEvent{Event: event, Room: roomID, At: time.Now(), Data: data})
+}
+
+func (d *webhookDispatcher) push(event webhookEvent) {
+	d.lock.Lock()
+	if len(d.queue) >= webhookQueueSize {
+		d.queue = d.queue[1:]
+		webhookEventsDropped.Inc()
+	}
+	d.queue = append(d.queue, event)
+	d.lock.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *webhookDispatcher) pop() (webhookEvent, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.queue) == 0 {
+		return webhookEvent{}, false
+	}
+	event := d.queue[0]
+	d.queue = d.queue[1:]
+	return event, true
+}
+
+// run delivers queued events in order, for the life of the process.
+func (d *webhookDispatcher) run(url string) {
+	for range d.wake {
+		for {
+			event, ok := d.pop()
+			if !ok {
+				break
+			}
+			d.deliver(url, event)
+		}
+	}
+}
+
+// deliver retries with doubling backoff until the webhook accepts the
+// event or the attempts run out. Client errors aren't retried, since
+// sending the same body again won't help.
+func (d *webhookDispatcher) deliver(url string, event webhookEvent) {
+	body := marshal(event)
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := d.post(url, body)
+		if err == nil {
+			return
+		}
+		retry := attempt < webhookAttempts
+		if statusErr, ok := err.(webhookStatusError); ok && statusErr < 500 {
+			retry = false
+		}
+		if !retry {
+			webhookEventsDropped.Inc()
+			slog.Warn("Webhook delivery failed", "event", "webhook_failed", "webhook_event", event.Event, "room_id", event.Room, "attempts", attempt, "error", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+type webhookStatusError int
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook answered %d", int(e))
+}
+
+func (d *webhookDispatcher) post(url string, body []byte) error {
+	res, err := d.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return webhookStatusError(res.StatusCode)
+	}
+	return nil
+}